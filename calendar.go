@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type (
+	// timeRange is a time range from a calendar or date list, end is exclusive
+	timeRange struct {
+		Start  time.Time
+		End    time.Time
+		Yearly bool // repeats every year until Until
+		Until  time.Time
+		Except []time.Time // starts of repetitions removed by EXDATE
+	}
+)
+
+// contains checks if now is within the range or one of its yearly repetitions
+func (r timeRange) contains(now time.Time) bool {
+	if !r.Yearly {
+		return !now.Before(r.Start) && now.Before(r.End) && !r.excluded(r.Start)
+	}
+	// a repetition may have started in the last year
+	for _, year := range []int{now.Year() - 1, now.Year()} {
+		shift := year - r.Start.Year()
+		start := r.Start.AddDate(shift, 0, 0)
+		if start.Before(r.Start) || (!r.Until.IsZero() && start.After(r.Until)) || r.excluded(start) {
+			continue
+		}
+		if !now.Before(start) && now.Before(r.End.AddDate(shift, 0, 0)) {
+			return true
+		}
+	}
+	return false
+}
+
+// excluded checks if the repetition starting at start was removed by EXDATE
+func (r timeRange) excluded(start time.Time) bool {
+	for _, except := range r.Except {
+		if except.Equal(start) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadCalendar reads the events of an iCalendar file
+func loadCalendar(path string, location *time.Location) ([]timeRange, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open calendar: %s", err)
+	}
+	defer file.Close()
+	ranges, err := parseICS(file, location)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse calendar %s: %s", path, err)
+	}
+	return ranges, nil
+}
+
+// parseICS parses the VEVENTs of an iCalendar, events with unsupported recurrence rules are skipped
+func parseICS(r io.Reader, location *time.Location) ([]timeRange, error) {
+	lines, err := unfoldICS(r)
+	if err != nil {
+		return nil, err
+	}
+	ranges := []timeRange{}
+	inEvent := false
+	var start, end time.Time
+	var startIsDate bool
+	var duration time.Duration
+	var rrule, summary string
+	var except []time.Time
+	for _, line := range lines {
+		name, params, value := splitICSLine(line)
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			inEvent = true
+			start, end, startIsDate, duration, rrule, summary = time.Time{}, time.Time{}, false, 0, "", ""
+			except = nil
+		case name == "END" && value == "VEVENT":
+			inEvent = false
+			if start.IsZero() {
+				continue
+			}
+			switch {
+			case !end.IsZero():
+			case duration > 0:
+				end = start.Add(duration)
+			case startIsDate:
+				end = start.AddDate(0, 0, 1)
+			default:
+				continue
+			}
+			tr := timeRange{Start: start, End: end, Except: except}
+			if rrule != "" {
+				if err := applyRRule(&tr, rrule, location); err != nil {
+					// one odd event must not take down every job using the calendar
+					log.Warn().Err(err).Str("event", summary).Msg("skipping calendar event")
+					continue
+				}
+			}
+			ranges = append(ranges, tr)
+		case !inEvent:
+		case name == "DTSTART":
+			start, startIsDate, err = parseICSTime(params, value, location)
+			if err != nil {
+				return nil, err
+			}
+		case name == "DTEND":
+			end, _, err = parseICSTime(params, value, location)
+			if err != nil {
+				return nil, err
+			}
+		case name == "DURATION":
+			duration, err = parseICSDuration(value)
+			if err != nil {
+				return nil, err
+			}
+		case name == "RRULE":
+			rrule = value
+		case name == "EXDATE":
+			for _, v := range strings.Split(value, ",") {
+				t, _, err := parseICSTime(params, v, location)
+				if err != nil {
+					return nil, err
+				}
+				except = append(except, t)
+			}
+		case name == "SUMMARY":
+			summary = value
+		}
+	}
+	return ranges, nil
+}
+
+// unfoldICS joins continuation lines, they start with a space or tab
+func unfoldICS(r io.Reader) ([]string, error) {
+	lines := []string{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), "\r")
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, s.Err()
+}
+
+// splitICSLine splits 'NAME;PARAM=VALUE:value'
+func splitICSLine(line string) (name string, params map[string]string, value string) {
+	params = map[string]string{}
+	parts := strings.SplitN(line, ":", 2)
+	if len(parts) == 2 {
+		value = parts[1]
+	}
+	fields := strings.Split(parts[0], ";")
+	for _, param := range fields[1:] {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return strings.ToUpper(fields[0]), params, value
+}
+
+// parseICSTime parses DATE and DATE-TIME values, floating times use location
+func parseICSTime(params map[string]string, value string, location *time.Location) (t time.Time, isDate bool, err error) {
+	if tzid, ok := params["TZID"]; ok {
+		location, err = time.LoadLocation(tzid)
+		if err != nil {
+			return t, false, fmt.Errorf("unknown TZID %s", tzid)
+		}
+	}
+	switch {
+	case params["VALUE"] == "DATE" || len(value) == 8:
+		t, err = time.ParseInLocation("20060102", value, location)
+		return t, true, err
+	case strings.HasSuffix(value, "Z"):
+		t, err = time.Parse("20060102T150405Z", value)
+		return t, false, err
+	default:
+		t, err = time.ParseInLocation("20060102T150405", value, location)
+		return t, false, err
+	}
+}
+
+// parseICSDuration parses durations like P1D, PT2H30M or P1W
+func parseICSDuration(value string) (time.Duration, error) {
+	invalid := fmt.Errorf("invalid duration %s", value)
+	value = strings.TrimPrefix(value, "+")
+	if !strings.HasPrefix(value, "P") {
+		return 0, invalid
+	}
+	units := map[byte]time.Duration{
+		'W': 7 * 24 * time.Hour,
+		'D': 24 * time.Hour,
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+	}
+	duration := time.Duration(0)
+	number := ""
+	for i := 1; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == 'T':
+		case c >= '0' && c <= '9':
+			number += string(c)
+		default:
+			unit, ok := units[c]
+			n, err := strconv.Atoi(number)
+			if !ok || err != nil {
+				return 0, invalid
+			}
+			duration += time.Duration(n) * unit
+			number = ""
+		}
+	}
+	return duration, nil
+}
+
+// applyRRule applies a yearly recurrence rule to the range, BYMONTH and BYMONTHDAY
+// are only accepted if they repeat the date of the start
+func applyRRule(tr *timeRange, rrule string, location *time.Location) error {
+	rule := map[string]string{}
+	for _, part := range strings.Split(rrule, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) == 2 {
+			rule[strings.ToUpper(kv[0])] = kv[1]
+		}
+	}
+	unsupported := fmt.Errorf("unsupported RRULE %s, only FREQ=YEARLY on the date of DTSTART is supported", rrule)
+	if rule["FREQ"] != "YEARLY" || (rule["INTERVAL"] != "" && rule["INTERVAL"] != "1") {
+		return unsupported
+	}
+	for key, value := range rule {
+		switch key {
+		case "FREQ", "INTERVAL", "UNTIL", "COUNT", "WKST":
+		case "BYMONTH":
+			if value != strconv.Itoa(int(tr.Start.Month())) {
+				return unsupported
+			}
+		case "BYMONTHDAY":
+			if value != strconv.Itoa(tr.Start.Day()) {
+				return unsupported
+			}
+		default:
+			return unsupported
+		}
+	}
+	tr.Yearly = true
+	if until, ok := rule["UNTIL"]; ok {
+		t, _, err := parseICSTime(map[string]string{}, until, location)
+		if err != nil {
+			return fmt.Errorf("invalid UNTIL in RRULE %s", rrule)
+		}
+		tr.Until = t
+	}
+	if count, ok := rule["COUNT"]; ok {
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid COUNT in RRULE %s", rrule)
+		}
+		tr.Until = tr.Start.AddDate(n-1, 0, 0)
+	}
+	return nil
+}
+
+// loadDateList reads a list of dates, one date '2006-01-02' or range '2006-01-02..2006-01-05' per line
+func loadDateList(path string, location *time.Location) ([]timeRange, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open date list: %s", err)
+	}
+	defer file.Close()
+	ranges, err := parseDateList(file, location)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse date list %s: %s", path, err)
+	}
+	return ranges, nil
+}
+
+// parseDateList parses a list of dates, empty lines and comments starting with # are ignored
+func parseDateList(r io.Reader, location *time.Location) ([]timeRange, error) {
+	ranges := []timeRange{}
+	s := bufio.NewScanner(r)
+	n := 0
+	for s.Scan() {
+		n++
+		line := s.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		dates := strings.SplitN(fields[0], "..", 2)
+		start, err := time.ParseInLocation("2006-01-02", dates[0], location)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid date %s", n, dates[0])
+		}
+		end := start
+		if len(dates) == 2 {
+			end, err = time.ParseInLocation("2006-01-02", dates[1], location)
+			if err != nil || end.Before(start) {
+				return nil, fmt.Errorf("line %d: invalid date range %s", n, fields[0])
+			}
+		}
+		ranges = append(ranges, timeRange{Start: start, End: end.AddDate(0, 0, 1)})
+	}
+	return ranges, s.Err()
+}
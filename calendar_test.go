@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestParseICS(c *check.C) {
+	ics := strings.ReplaceAll(`BEGIN:VCALENDAR
+VERSION:2.0
+BEGIN:VEVENT
+SUMMARY:Christmas
+DTSTART;VALUE=DATE:20201224
+DTEND;VALUE=DATE:20201227
+RRULE:FREQ=YEARLY
+END:VEVENT
+BEGIN:VEVENT
+SUMMARY:Change freeze with a very long description that is
+ folded
+DTSTART;TZID=Europe/Berlin:20220301T080000
+DURATION:PT10H
+END:VEVENT
+BEGIN:VEVENT
+SUMMARY:Single day
+DTSTART:20220401
+END:VEVENT
+BEGIN:VEVENT
+SUMMARY:Until
+DTSTART:20220502T100000Z
+DTEND:20220502T110000Z
+RRULE:FREQ=YEARLY;UNTIL=20230502T100000Z
+END:VEVENT
+BEGIN:VEVENT
+SUMMARY:Weekly
+DTSTART:20220502T100000Z
+DTEND:20220502T110000Z
+RRULE:FREQ=WEEKLY
+END:VEVENT
+BEGIN:VEVENT
+SUMMARY:Thanksgiving
+DTSTART;VALUE=DATE:20221124
+RRULE:FREQ=YEARLY;BYMONTH=11;BYDAY=4TH
+END:VEVENT
+BEGIN:VEVENT
+SUMMARY:Unity Day
+DTSTART;VALUE=DATE:20201003
+RRULE:FREQ=YEARLY;BYMONTH=10;BYMONTHDAY=3
+EXDATE;VALUE=DATE:20211003,20231003
+END:VEVENT
+END:VCALENDAR
+`, "\n", "\r\n")
+	ranges, err := parseICS(strings.NewReader(ics), time.UTC)
+	c.Assert(err, check.IsNil)
+	c.Assert(ranges, check.HasLen, 5)
+
+	window := &quietWindow{Ranges: ranges, Location: time.UTC}
+	cases := []struct {
+		now    time.Time
+		active bool
+	}{
+		{time.Date(2022, 12, 25, 12, 0, 0, 0, time.UTC), true},
+		{time.Date(2022, 12, 27, 0, 0, 0, 0, time.UTC), false},
+		{time.Date(2019, 12, 25, 12, 0, 0, 0, time.UTC), false},
+		{time.Date(2022, 3, 1, 7, 30, 0, 0, time.UTC), true},
+		{time.Date(2022, 3, 1, 17, 30, 0, 0, time.UTC), false},
+		{time.Date(2022, 3, 1, 6, 30, 0, 0, time.UTC), false},
+		{time.Date(2022, 4, 1, 23, 59, 0, 0, time.UTC), true},
+		{time.Date(2022, 5, 2, 10, 30, 0, 0, time.UTC), true},
+		{time.Date(2022, 5, 9, 10, 30, 0, 0, time.UTC), false},
+		{time.Date(2023, 5, 2, 10, 30, 0, 0, time.UTC), true},
+		{time.Date(2024, 5, 2, 10, 30, 0, 0, time.UTC), false},
+		{time.Date(2023, 11, 23, 12, 0, 0, 0, time.UTC), false},
+		{time.Date(2022, 10, 3, 12, 0, 0, 0, time.UTC), true},
+		{time.Date(2021, 10, 3, 12, 0, 0, 0, time.UTC), false},
+		{time.Date(2023, 10, 3, 12, 0, 0, 0, time.UTC), false},
+	}
+	for _, cse := range cases {
+		c.Assert(window.active(cse.now), check.Equals, cse.active, check.Commentf("now: %s", cse.now))
+	}
+}
+
+func (s *Suite) TestParseDateList(c *check.C) {
+	list := `# public holidays
+2022-10-03 German Unity Day
+2022-12-24..2022-12-26 # christmas
+
+`
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	c.Assert(err, check.IsNil)
+	ranges, err := parseDateList(strings.NewReader(list), berlin)
+	c.Assert(err, check.IsNil)
+	c.Assert(ranges, check.HasLen, 2)
+
+	window := &quietWindow{Ranges: ranges, Location: berlin}
+	c.Assert(window.active(time.Date(2022, 10, 3, 12, 0, 0, 0, berlin)), check.Equals, true)
+	c.Assert(window.active(time.Date(2022, 10, 2, 23, 0, 0, 0, time.UTC)), check.Equals, true)
+	c.Assert(window.active(time.Date(2022, 10, 4, 0, 0, 0, 0, berlin)), check.Equals, false)
+	c.Assert(window.active(time.Date(2022, 12, 26, 23, 0, 0, 0, berlin)), check.Equals, true)
+	c.Assert(window.active(time.Date(2022, 12, 27, 0, 0, 0, 0, berlin)), check.Equals, false)
+
+	_, err = parseDateList(strings.NewReader("2022-12-26..2022-12-24\n"), berlin)
+	c.Assert(err, check.ErrorMatches, "line 1: invalid date range .*")
+	_, err = parseDateList(strings.NewReader("tomorrow\n"), berlin)
+	c.Assert(err, check.ErrorMatches, "line 1: invalid date tomorrow")
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+type (
+	// Monitor is the Sentry Crons monitor of a cron
+	Monitor struct {
+		Slug          string   `yaml:"slug"`
+		Schedule      string   `yaml:"schedule"`
+		CheckinMargin Duration `yaml:"checkin_margin"`
+		MaxRuntime    Duration `yaml:"max_runtime"`
+		Timezone      string   `yaml:"timezone"`
+	}
+
+	// checkIn is the payload of a Sentry Crons check-in
+	checkIn struct {
+		ID            string         `json:"check_in_id"`
+		MonitorSlug   string         `json:"monitor_slug"`
+		Status        string         `json:"status"`
+		Duration      float64        `json:"duration,omitempty"`
+		MonitorConfig *monitorConfig `json:"monitor_config,omitempty"`
+	}
+
+	// monitorConfig creates or updates the monitor with the check-in
+	monitorConfig struct {
+		Schedule struct {
+			Type  string `json:"type"`
+			Value string `json:"value"`
+		} `json:"schedule"`
+		CheckinMargin int    `json:"checkin_margin,omitempty"`
+		MaxRuntime    int    `json:"max_runtime,omitempty"`
+		Timezone      string `json:"timezone,omitempty"`
+	}
+)
+
+// check-in status
+const (
+	checkInProgress = "in_progress"
+	checkInOK       = "ok"
+	checkInError    = "error"
+)
+
+// unsafeSlug matches the characters that are replaced in monitor slugs
+var unsafeSlug = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+// cronMonitor returns the monitor of the cron, nil if check-ins are disabled. the
+// flags take precedence over the monitor configured for the cron name
+func cronMonitor(cr *CmdRequest) *Monitor {
+	monitor := cr.Monitor
+	configured, isConfigured := Monitor{}, false
+	if cr.Config != nil {
+		configured, isConfigured = cr.Config.Monitors[cr.Name]
+		isConfigured = isConfigured || cr.Config.SentryCrons
+	}
+	if monitor.Slug == "" && !isConfigured {
+		return nil
+	}
+	if monitor.Slug == "" {
+		monitor.Slug = configured.Slug
+	}
+	if monitor.Slug == "" {
+		monitor.Slug = strings.Trim(unsafeSlug.ReplaceAllString(strings.ToLower(cr.Name), "-"), "-")
+	}
+	if monitor.Schedule == "" {
+		monitor.Schedule = configured.Schedule
+	}
+	if monitor.CheckinMargin == 0 {
+		monitor.CheckinMargin = configured.CheckinMargin
+	}
+	if monitor.MaxRuntime == 0 {
+		monitor.MaxRuntime = configured.MaxRuntime
+	}
+	if monitor.Timezone == "" {
+		monitor.Timezone = configured.Timezone
+	}
+	return &monitor
+}
+
+// newCheckIn creates a check-in for the monitor
+func (m *Monitor) newCheckIn(id string, status string, duration time.Duration) *checkIn {
+	c := &checkIn{ID: id, MonitorSlug: m.Slug, Status: status}
+	if status != checkInProgress {
+		c.Duration = duration.Seconds()
+	}
+	if m.Schedule != "" {
+		c.MonitorConfig = &monitorConfig{Timezone: m.Timezone}
+		c.MonitorConfig.Schedule.Type = "crontab"
+		c.MonitorConfig.Schedule.Value = m.Schedule
+		// sentry expects minutes
+		c.MonitorConfig.CheckinMargin = int(time.Duration(m.CheckinMargin).Minutes())
+		c.MonitorConfig.MaxRuntime = int(time.Duration(m.MaxRuntime).Minutes())
+	}
+	return c
+}
+
+// checkInStatus maps the result of the cron to a check-in status, quiet crons are
+// ok. a run skipped by the lock or semaphore did not run and is an error
+func checkInStatus(result *RunResult) string {
+	if result.Skipped != "" {
+		return checkInError
+	}
+	err := result.Err
+	if err == nil {
+		return checkInOK
+	}
+	quietErr := &QuietError{}
+	if errors.As(err, &quietErr) {
+		return checkInOK
+	}
+	return checkInError
+}
+
+// sendCheckIn posts the check-in as envelope, sentry-go does not support check-ins
+func sendCheckIn(ctx context.Context, client *http.Client, dsn *sentry.Dsn, c *checkIn) error {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	envelope, err := buildEnvelope(
+		map[string]interface{}{
+			"sent_at": time.Now().UTC().Format(time.RFC3339),
+			"dsn":     dsn.String(),
+		},
+		envelopeItem{Header: map[string]interface{}{"type": "check_in"}, Payload: payload},
+	)
+	if err != nil {
+		return err
+	}
+	if err := postEnvelope(ctx, client, dsn, envelope); err != nil {
+		return fmt.Errorf("unable to send check-in: %s", err)
+	}
+	return nil
+}
+
+// newCheckInID returns a random id in the format sentry expects
+func newCheckInID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
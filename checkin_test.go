@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestCronMonitor(c *check.C) {
+	cr := &CmdRequest{Name: "Backup DB", Config: &Config{}}
+	c.Assert(cronMonitor(cr), check.IsNil)
+
+	cr.Config.SentryCrons = true
+	c.Assert(cronMonitor(cr), check.DeepEquals, &Monitor{Slug: "backup-db"})
+
+	cr.Config.Monitors = map[string]Monitor{
+		"Backup DB": {Slug: "db", Schedule: "0 3 * * *", CheckinMargin: Duration(5 * time.Minute)},
+	}
+	cr.Monitor.Schedule = "0 4 * * *"
+	c.Assert(cronMonitor(cr), check.DeepEquals, &Monitor{
+		Slug: "db", Schedule: "0 4 * * *", CheckinMargin: Duration(5 * time.Minute),
+	})
+
+	checkIn := cronMonitor(cr).newCheckIn("id", checkInError, 90*time.Second)
+	c.Assert(checkIn.Duration, check.Equals, 90.0)
+	c.Assert(checkIn.MonitorConfig.Schedule.Value, check.Equals, "0 4 * * *")
+	c.Assert(checkIn.MonitorConfig.CheckinMargin, check.Equals, 5)
+
+	c.Assert(checkInStatus(&RunResult{}), check.Equals, checkInOK)
+	c.Assert(checkInStatus(&RunResult{Err: &QuietError{Mode: quietSkip}}), check.Equals, checkInOK)
+	c.Assert(checkInStatus(&RunResult{Err: errors.New("exit status 1")}), check.Equals, checkInError)
+	c.Assert(checkInStatus(&RunResult{Skipped: "cron is still running, pid: 42"}), check.Equals, checkInError)
+}
+
+func (s *Suite) TestCheckIn(c *check.C) {
+	mutex := sync.Mutex{}
+	checkIns := []checkIn{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/5/envelope/", func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Header.Get("X-Sentry-Auth"), check.Matches, ".*sentry_key=testuser.*")
+		for _, item := range readEnvelope(c, r.Body) {
+			if item.Header["type"] != "check_in" {
+				continue
+			}
+			checkIn := checkIn{}
+			c.Assert(json.Unmarshal(item.Payload, &checkIn), check.IsNil)
+			mutex.Lock()
+			checkIns = append(checkIns, checkIn)
+			mutex.Unlock()
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	os.Setenv("CRONGUARD_SENTRY_DSN", fmt.Sprintf("http://testuser@%s/5", server.Listener.Addr().String()))
+	defer os.Unsetenv("CRONGUARD_SENTRY_DSN")
+
+	cr := &CmdRequest{Name: "backup", Command: "backup.sh", Status: &CmdStatus{}}
+	cr.Monitor.Slug = "backup"
+	cr.Status.Stdout = &bytes.Buffer{}
+	cr.Status.Stderr = &bytes.Buffer{}
+	reporter, err := newReporter(cr)
+	c.Assert(err, check.IsNil)
+	reporter.Start()
+	_ = reporter.Finish(errors.New("exit status 1"))
+
+	c.Assert(checkIns, check.HasLen, 2)
+	c.Assert(checkIns[0].Status, check.Equals, checkInProgress)
+	c.Assert(checkIns[0].MonitorSlug, check.Equals, "backup")
+	c.Assert(checkIns[0].MonitorConfig, check.IsNil)
+	c.Assert(checkIns[1].Status, check.Equals, checkInError)
+	c.Assert(checkIns[1].ID, check.Equals, checkIns[0].ID)
+	c.Assert(checkIns[1].Duration > 0, check.Equals, true)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -9,10 +10,213 @@ import (
 type (
 	// Config holds the optional and global configuration
 	Config struct {
-		SentryDSN string `yaml:"sentry_dsn"`
+		SentryDSN  string              `yaml:"sentry_dsn"`
+		Rules      map[string]RulePack `yaml:"rules"`
+		Windows    map[string]Window   `yaml:"windows"`
+		StateDir   string              `yaml:"state_dir"`
+		RuntimeDir string              `yaml:"runtime_dir"`
+		Locks      LockConfig          `yaml:"locks"`
+
+		HTTP   HTTPConfig           `yaml:"http"`
+		Sentry SentryConfig         `yaml:"sentry"`
+		Jobs   map[string]JobConfig `yaml:"jobs"`
+		Spool  SpoolConfig          `yaml:"spool"`
+
+		SentryCrons bool               `yaml:"sentry_crons"`
+		Monitors    map[string]Monitor `yaml:"monitors"`
+
+		Notifiers map[string]NotifierConfig `yaml:"notifiers"`
+	}
+
+	// NotifierConfig configures a notification backend, the run results are sent to all backends in parallel
+	NotifierConfig struct {
+		Timeout Duration       `yaml:"timeout"`
+		Webhook *WebhookConfig `yaml:"webhook"`
+		SMTP    *SMTPConfig    `yaml:"smtp"`
+		Slack   *SlackConfig   `yaml:"slack"`
+	}
+
+	// WebhookConfig configures a http webhook, the body is a template of the run result
+	WebhookConfig struct {
+		URL     string            `yaml:"url"`
+		Method  string            `yaml:"method"`
+		Headers map[string]string `yaml:"headers"`
+		Body    string            `yaml:"body"`
+	}
+
+	// SentryConfig configures the sentry events
+	SentryConfig struct {
+		Environment string            `yaml:"environment"`
+		Release     string            `yaml:"release"`
+		ServerName  string            `yaml:"server_name"`
+		Tags        map[string]string `yaml:"tags"`
+		Fingerprint []string          `yaml:"fingerprint"`
+		Timeout     Duration          `yaml:"timeout"`
+
+		AttachmentMaxSize int `yaml:"attachment_max_size"`
+		SummaryLines      int `yaml:"summary_lines"`
+
+		// resolve issues on recovery using the sentry api
+		APIURL   string `yaml:"api_url"`
+		APIToken string `yaml:"api_token"`
+		Org      string `yaml:"org"`
+		Project  string `yaml:"project"`
+	}
+
+	// JobConfig is the configuration of a single cron, selected by its name
+	JobConfig struct {
+		Tags        map[string]string `yaml:"tags"`
+		Fingerprint []string          `yaml:"fingerprint"`
+		Notifiers   []string          `yaml:"notifiers"` // all notifiers if not set, "sentry" is the built-in sentry notifier
+		MailTo      []string          `yaml:"mailto"`
+		Slack       SlackJobConfig    `yaml:"slack"`
+	}
+
+	// SMTPConfig configures an email notifier, mails are only sent for failed crons.
+	// STARTTLS is used if the server supports it
+	SMTPConfig struct {
+		Addr       string   `yaml:"addr"`
+		Username   string   `yaml:"username"`
+		Password   string   `yaml:"password"`
+		RequireTLS bool     `yaml:"require_tls"`
+		From       string   `yaml:"from"`
+		To         []string `yaml:"to"`
+		Subject    string   `yaml:"subject"`
+		Body       string   `yaml:"body"`
+		Lines      int      `yaml:"lines"`
+	}
+
+	// SlackConfig configures a Slack or Mattermost notifier using an incoming webhook, recoveries
+	// are separate messages then. only the Slack api with a token sends them as thread replies
+	SlackConfig struct {
+		URL       string `yaml:"url"`
+		Token     string `yaml:"token"`
+		APIURL    string `yaml:"api_url"`
+		IconEmoji string `yaml:"icon_emoji"`
+		Lines     int    `yaml:"lines"`
+
+		SlackJobConfig `yaml:",inline"`
+	}
+
+	// SlackJobConfig are the Slack settings that can be changed per job
+	SlackJobConfig struct {
+		Channel   string   `yaml:"channel"`
+		Username  string   `yaml:"username"`
+		Mentions  []string `yaml:"mentions"`
+		MentionOn []string `yaml:"mention_on"` // severities that mention, defaults to error
+	}
+
+	// LockConfig configures the shared lock backends
+	LockConfig struct {
+		Dir           string   `yaml:"dir"`
+		Redis         string   `yaml:"redis"`
+		RedisPassword string   `yaml:"redis_password"`
+		RedisDB       int      `yaml:"redis_db"`
+		Lease         Duration `yaml:"lease"`
 	}
 )
 
+// defaultStateDir is used if no state_dir is configured
+const defaultStateDir = "/var/lib/cronguard"
+
+// stateDir returns the directory for state that is kept between runs
+func (c *Config) stateDir() string {
+	if dir, ok := os.LookupEnv("CRONGUARD_STATE_DIR"); ok {
+		return dir
+	}
+	if c != nil && c.StateDir != "" {
+		return c.StateDir
+	}
+	return defaultStateDir
+}
+
+// defaultLease is the lease time of shared locks, the lease is renewed while the cron runs
+const defaultLease = 30 * time.Second
+
+// lease returns the lease time of shared locks
+func (c LockConfig) lease() time.Duration {
+	if c.Lease > 0 {
+		return time.Duration(c.Lease)
+	}
+	return defaultLease
+}
+
+// defaultRuntimeDir is used if no runtime_dir is configured
+const defaultRuntimeDir = "/run/cronguard"
+
+// runtimeDir returns the directory for state that is only kept until reboot, like locks
+func (c *Config) runtimeDir() string {
+	if dir, ok := os.LookupEnv("CRONGUARD_RUNTIME_DIR"); ok {
+		return dir
+	}
+	if c != nil && c.RuntimeDir != "" {
+		return c.RuntimeDir
+	}
+	return defaultRuntimeDir
+}
+
+// job returns the configuration of the cron name, empty if there is none
+func (c *Config) job(name string) JobConfig {
+	if c == nil {
+		return JobConfig{}
+	}
+	return c.Jobs[name]
+}
+
+// sentryConfig returns the sentry config, the defaults if there is no config
+func (c *Config) sentryConfig() SentryConfig {
+	if c == nil {
+		return SentryConfig{}
+	}
+	return c.Sentry
+}
+
+// timeout returns the timeout to deliver a sentry report, defaults to the http timeout
+func (c SentryConfig) timeout(http HTTPConfig) time.Duration {
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout)
+	}
+	return http.timeout()
+}
+
+// notifiers returns the configured notifiers, nil if there is no config
+func (c *Config) notifiers() map[string]NotifierConfig {
+	if c == nil {
+		return nil
+	}
+	return c.Notifiers
+}
+
+// timeout returns the timeout to deliver a report, defaults to the http timeout
+func (c NotifierConfig) timeout(http HTTPConfig) time.Duration {
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout)
+	}
+	return http.timeout()
+}
+
+// defaultAttachmentMaxSize is the maximum size of an output attachment before compression
+const defaultAttachmentMaxSize = 1 << 20
+
+// attachmentMaxSize returns the maximum size of an output attachment, only the tail of larger output is attached
+func (c SentryConfig) attachmentMaxSize() int {
+	if c.AttachmentMaxSize > 0 {
+		return c.AttachmentMaxSize
+	}
+	return defaultAttachmentMaxSize
+}
+
+// defaultSummaryLines is the number of output lines in the event extras
+const defaultSummaryLines = 20
+
+// summaryLines returns the number of output lines in the event extras
+func (c SentryConfig) summaryLines() int {
+	if c.SummaryLines > 0 {
+		return c.SummaryLines
+	}
+	return defaultSummaryLines
+}
+
 // ParseConfig loads the Configfile if there is one or uses defaults
 func ParseConfig() *Config {
 	c := Config{}
@@ -37,3 +241,20 @@ func open(files ...string) (*os.File, error) {
 	}
 	return nil, err
 }
+
+// Duration is a time.Duration that is parsed from golang duration strings like "42m"
+type Duration time.Duration
+
+// UnmarshalYAML satisfies yaml.Unmarshaler
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/rs/zerolog/log"
+)
+
+type (
+	// envelopeItem is a single item of a sentry envelope
+	envelopeItem struct {
+		Header  map[string]interface{}
+		Payload []byte
+	}
+
+	// attachment is a file attached to a sentry event
+	attachment struct {
+		Filename    string
+		ContentType string
+		Data        []byte
+	}
+
+	// envelopeTransport sends events with their attachments as envelopes,
+	// the transports of sentry-go do not support attachments
+	envelopeTransport struct {
+		dsn     *sentry.Dsn
+		client  *http.Client
+		timeout time.Duration // deadline of a single envelope, SentryTimeout if unset
+
+		spool *spool // undelivered envelopes are spooled if set
+
+		mutex       sync.Mutex
+		attachments []attachment // attachments for the next event
+		pending     sync.WaitGroup
+		inflight    map[int][]byte
+		next        int
+		failed      bool
+	}
+
+	// envelopeError is returned if sentry rejected an envelope
+	envelopeError struct {
+		StatusCode int
+		Status     string
+	}
+)
+
+// Error satisfies the error interface
+func (e *envelopeError) Error() string {
+	return e.Status
+}
+
+// retryable checks if an envelope may be delivered later, sentry was unreachable, overloaded or rate limited it
+func retryable(err error) bool {
+	envErr := &envelopeError{}
+	if errors.As(err, &envErr) {
+		return envErr.StatusCode == http.StatusTooManyRequests || envErr.StatusCode >= 500
+	}
+	return true
+}
+
+// buildEnvelope serializes the envelope header and items
+func buildEnvelope(header map[string]interface{}, items ...envelopeItem) ([]byte, error) {
+	body := &bytes.Buffer{}
+	enc := json.NewEncoder(body)
+	if err := enc.Encode(header); err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		item.Header["length"] = len(item.Payload)
+		if err := enc.Encode(item.Header); err != nil {
+			return nil, err
+		}
+		body.Write(item.Payload)
+		body.WriteByte('\n')
+	}
+	return body.Bytes(), nil
+}
+
+// postEnvelope sends an envelope to sentry
+func postEnvelope(ctx context.Context, client *http.Client, dsn *sentry.Dsn, envelope []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, dsn.EnvelopeAPIURL().String(), bytes.NewReader(envelope))
+	if err != nil {
+		return err
+	}
+	for key, value := range dsn.RequestHeaders() {
+		request.Header.Set(key, value)
+	}
+	request.Header.Set("Content-Type", "application/x-sentry-envelope")
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode >= 300 {
+		return &envelopeError{StatusCode: response.StatusCode, Status: response.Status}
+	}
+	return nil
+}
+
+// gzipAttachment compresses data, only the last max bytes are kept
+func gzipAttachment(filename string, data []byte, max int) attachment {
+	if max > 0 && len(data) > max {
+		truncated := fmt.Sprintf("[cronguard: truncated %d bytes]\n", len(data)-max)
+		data = append([]byte(truncated), data[len(data)-max:]...)
+	}
+	compressed := &bytes.Buffer{}
+	w := gzip.NewWriter(compressed)
+	_, _ = w.Write(data)
+	_ = w.Close()
+	return attachment{Filename: filename + ".gz", ContentType: "application/gzip", Data: compressed.Bytes()}
+}
+
+// Configure satisfies the sentry.Transport interface
+func (t *envelopeTransport) Configure(options sentry.ClientOptions) {
+	dsn, err := sentry.NewDsn(options.Dsn)
+	if err != nil {
+		log.Warn().Err(err).Msg("invalid sentry dsn")
+		return
+	}
+	t.dsn = dsn
+	t.client = options.HTTPClient
+	if t.client == nil {
+		t.client = &http.Client{Transport: options.HTTPTransport}
+	}
+}
+
+// attach adds attachments to the next event
+func (t *envelopeTransport) attach(attachments ...attachment) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.attachments = append(t.attachments, attachments...)
+}
+
+// SendEvent satisfies the sentry.Transport interface
+func (t *envelopeTransport) SendEvent(event *sentry.Event) {
+	t.mutex.Lock()
+	attachments := t.attachments
+	t.attachments = nil
+	t.mutex.Unlock()
+	if t.dsn == nil {
+		return
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Warn().Err(err).Msg("unable to serialize sentry event")
+		return
+	}
+	items := []envelopeItem{{Header: map[string]interface{}{"type": "event"}, Payload: payload}}
+	for _, a := range attachments {
+		items = append(items, envelopeItem{
+			Header: map[string]interface{}{
+				"type":            "attachment",
+				"filename":        a.Filename,
+				"content_type":    a.ContentType,
+				"attachment_type": "event.attachment",
+			},
+			Payload: a.Data,
+		})
+	}
+	envelope, err := buildEnvelope(map[string]interface{}{
+		"event_id": event.EventID,
+		"sent_at":  time.Now().UTC().Format(time.RFC3339),
+		"dsn":      t.dsn.String(),
+	}, items...)
+	if err != nil {
+		log.Warn().Err(err).Msg("unable to serialize sentry event")
+		return
+	}
+
+	t.mutex.Lock()
+	if t.inflight == nil {
+		t.inflight = map[int][]byte{}
+	}
+	id := t.next
+	t.next++
+	t.inflight[id] = envelope
+	t.mutex.Unlock()
+
+	t.pending.Add(1)
+	go func() {
+		defer t.pending.Done()
+		timeout := t.timeout
+		if timeout <= 0 {
+			timeout = SentryTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		err := postEnvelope(ctx, t.client, t.dsn, envelope)
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		if _, ok := t.inflight[id]; !ok {
+			// already spooled by a timed out flush
+			return
+		}
+		delete(t.inflight, id)
+		if err != nil {
+			log.Debug().Err(err).Msg("unable to send sentry event")
+			t.failed = true
+			if retryable(err) {
+				t.spoolEnvelope(envelope)
+			}
+		}
+	}()
+}
+
+// spoolEnvelope writes an undelivered envelope to the spool, requires the mutex
+func (t *envelopeTransport) spoolEnvelope(envelope []byte) {
+	if t.spool == nil {
+		return
+	}
+	if err := t.spool.write(envelope); err != nil {
+		log.Warn().Err(err).Msg("unable to spool sentry event")
+		return
+	}
+	log.Info().Msg("sentry event spooled for later delivery")
+}
+
+// Flush satisfies the sentry.Transport interface, false if an event was not delivered
+func (t *envelopeTransport) Flush(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		t.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		// the process usually exits after flushing, keep the envelopes for later
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		for id, envelope := range t.inflight {
+			delete(t.inflight, id)
+			t.spoolEnvelope(envelope)
+		}
+		return false
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	failed := t.failed
+	t.failed = false
+	return !failed
+}
@@ -8,7 +8,11 @@ import (
 	stdlog "log"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"regexp"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -26,11 +30,27 @@ type (
 		ErrFileQuiet    bool
 		ErrFileHideUUID bool
 
-		QuietTimes string
-		Timeout    time.Duration
-		Lockfile   string
+		QuietTimes   string
+		QuietWindows string
+		QuietMode    string
+		Timeout      time.Duration
+		IdleTimeout  time.Duration
+		IdleAction   string
+		Lockfile     string
+		LockBackend  string
+		LockWait     time.Duration
 
-		Regex *regexp.Regexp
+		Semaphore     *semaphore
+		SemaphoreWait time.Duration
+
+		LockAlertSkips int
+		LockAlertAge   time.Duration
+
+		Regex        *regexp.Regexp
+		OutputFormat string
+		Rules        *Rules
+
+		Monitor Monitor
 
 		Config *Config
 
@@ -44,6 +64,13 @@ type (
 		Stderr   io.Writer // captures stderr
 		Combined io.Writer // captures stdout and stderr
 		ExitCode int       // captures the exitcode
+		Killed   string    // reason if cronguard killed the command
+		Skipped  string    // reason if the run was skipped by the lock or semaphore
+		Silenced string    // reason if a failure was silenced by a quiet window or silence
+		UUID     string    // prefix of the lines in the errfile
+
+		LockWaited      time.Duration // time waited for the lock
+		SemaphoreWaited time.Duration // time waited for a semaphore slot
 	}
 
 	// GuardFunc is a middleware function
@@ -64,23 +91,76 @@ func main() {
 			Logger(),
 	)
 
+	if len(os.Args) > 1 {
+		if subcommand, ok := subcommands[os.Args[1]]; ok {
+			zerolog.SetGlobalLevel(zerolog.InfoLevel)
+			if err := subcommand(os.Args[2:]); err != nil {
+				log.Fatal().Err(err).Msgf("%s failed", os.Args[1])
+			}
+			return
+		}
+	}
+
 	cr := CmdRequest{}
 	cr.Config = ParseConfig()
 	cr.Status = &CmdStatus{}
 	f := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
-	f.StringVar(&cr.Name, "name", "guard", "cron name in syslog")
+	f.StringVar(&cr.Name, "name", defaultName, "cron name in syslog")
 	f.StringVar(&cr.ErrFile, "errfile", "/var/log/cronstatus", "error report file")
 	f.BoolVar(&cr.ErrFileQuiet, "errfile-quiet", false, "hide timings in error report file")
 	f.BoolVar(&cr.ErrFileHideUUID, "errfile-no-uuid", false, "hide uuid in error report file")
 	f.StringVar(&cr.QuietTimes, "quiet-times", "", "time ranges to ignore errors, format 'start(cron format):duration(golang duration):...")
+	f.StringVar(&cr.QuietMode, "quiet-mode", quietSilence, "mode for quiet-times, 'silence', 'downgrade' or 'skip'")
+	f.StringVar(&cr.QuietWindows, "quiet-windows", "", "comma separated names of windows from the config to ignore errors")
 	f.DurationVar(&cr.Timeout, "timeout", 0, "timeout for the cron, set to enable")
+	f.DurationVar(&cr.IdleTimeout, "idle-timeout", 0, "maximum time without any output, set to enable")
+	f.StringVar(&cr.IdleAction, "idle-action", idleKill, "action on idle-timeout, 'kill' or 'warn'")
 	f.StringVar(&cr.Lockfile, "lockfile", "", "lockfile to prevent the cron running twice, set to enable")
+	lockFlag := f.Bool("lock", false, "prevent the cron running twice using a lockfile derived from the name")
+	f.StringVar(&cr.LockBackend, "lock-backend", lockFlock, "lock backend for the lockfile, 'flock', 'dir' or 'redis'")
+	f.DurationVar(&cr.LockWait, "lock-wait", 0, "time to wait for a running cron to release the lockfile, set to enable")
+	f.IntVar(&cr.LockAlertSkips, "lock-alert-skips", 0, "warn after this many consecutive runs were skipped due to the lockfile, set to enable")
+	f.DurationVar(&cr.LockAlertAge, "lock-alert-age", 0, "warn if a run skipped due to the lockfile is held longer than this, set to enable")
+	semaphoreFlag := f.String("semaphore", "", "host wide semaphore to limit concurrent crons, format 'name:slots', set to enable")
+	f.DurationVar(&cr.SemaphoreWait, "semaphore-wait", 0, "time to wait for a free semaphore slot, skipped if not set")
+	f.StringVar(&cr.Monitor.Slug, "monitor", "", "slug of the Sentry Crons monitor to send check-ins, set to enable")
+	f.StringVar(&cr.Monitor.Schedule, "monitor-schedule", "", "crontab schedule to create or update the Sentry Crons monitor")
+	monitorMargin := f.Duration("monitor-margin", 0, "check-in margin of the Sentry Crons monitor")
 	f.BoolVar(&cr.Debug, "debug", false, "enable debugging")
-	regexFlag := f.String("regex", `(?im)\b(err|fail|crit)`, "regex for bad words")
+	parseValidation := validationFlags(f, &cr)
 	if err := f.Parse(os.Args[1:]); err != nil {
 		log.Fatal().Err(err).Msg("unable to parse arguments")
 	}
-	cr.Regex = regexp.MustCompile(*regexFlag)
+	if err := parseValidation(); err != nil {
+		log.Fatal().Err(err).Msg("invalid output validation")
+	}
+	cr.Monitor.CheckinMargin = Duration(*monitorMargin)
+	if *lockFlag {
+		if cr.Lockfile != "" {
+			log.Fatal().Msg("-lock and -lockfile are exclusive")
+		}
+		if !isFlagSet(f, "name") {
+			log.Fatal().Msg("-lock requires -name")
+		}
+		cr.Lockfile = lockPath(cr.Config, cr.Name)
+		if cr.LockBackend == lockFlock {
+			if err := os.MkdirAll(filepath.Dir(cr.Lockfile), 0755); err != nil {
+				log.Fatal().Err(err).Msg("unable to create lock directory")
+			}
+		}
+	}
+	if *semaphoreFlag != "" {
+		var err error
+		if cr.Semaphore, err = parseSemaphore(*semaphoreFlag); err != nil {
+			log.Fatal().Err(err).Msg("invalid semaphore")
+		}
+	}
+	if err := validQuietMode(cr.QuietMode); err != nil {
+		log.Fatal().Err(err).Msg("invalid quiet-mode")
+	}
+	if cr.IdleAction != idleKill && cr.IdleAction != idleWarn {
+		log.Fatal().Msgf("invalid idle-action: '%s'", cr.IdleAction)
+	}
 	if len(f.Args()) != 1 {
 		log.Fatal().Msgf("more than one command argument given: '%v'", f.Args())
 	}
@@ -92,8 +172,8 @@ func main() {
 	cr.Command = f.Arg(0)
 
 	r := chained(
-		runner, timeout, validateStdout, validateStderr, quietIgnore,
-		lockfile, sentryHandler, headerize, combineLogs, insertUUID,
+		runner, idleTimeout, timeout, validateExitCode, validateStdout, validateStderr, quietIgnore,
+		semaphoreSlot, lockfile, notifyHandler, headerize, combineLogs, insertUUID,
 		writeSyslog, setupLogs,
 	)
 	err := r(context.Background(), &cr)
@@ -102,6 +182,41 @@ func main() {
 	}
 }
 
+// subcommands are run instead of guarding a command if given as first argument
+var subcommands = map[string]func(args []string) error{
+	"test-rules": testRules,
+	"silence":    silenceCmd,
+	"locks":      locksCmd,
+	"spool":      spoolCmd,
+}
+
+// validationFlags adds the flags for the output validation, the returned
+// function sets up the validation after the flags are parsed
+func validationFlags(f *flag.FlagSet, cr *CmdRequest) func() error {
+	f.StringVar(&cr.OutputFormat, "output-format", outputText, "output format, 'text' or 'jsonl' to validate json log lines by level")
+	regexFlag := f.String("regex", `(?im)\b(err|fail|crit)`, "regex for bad words")
+	rulesFlag := f.String("rules", "", "comma separated rule packs to validate the output, replaces the default regex")
+	return func() (err error) {
+		cr.Regex, err = regexp.Compile(*regexFlag)
+		if err != nil {
+			return fmt.Errorf("invalid regex: %s", err)
+		}
+		if *rulesFlag != "" {
+			cr.Rules, err = compileRules(strings.Split(*rulesFlag, ","), cr.Config.Rules)
+			if err != nil {
+				return err
+			}
+			if !isFlagSet(f, "regex") {
+				cr.Regex = nil
+			}
+		}
+		if cr.OutputFormat != outputText && cr.OutputFormat != outputJSONL {
+			return fmt.Errorf("invalid output-format: '%s'", cr.OutputFormat)
+		}
+		return nil
+	}
+}
+
 // chained chaines all the middlewares together (reversed execution order)
 func chained(final func() GuardFunc, middlewares ...func(GuardFunc) GuardFunc) (g GuardFunc) {
 	g = final()
@@ -117,13 +232,41 @@ func runner() GuardFunc {
 		cmd := exec.CommandContext(ctx, "bash", "-c", cr.Command)
 		cmd.Stdout = cr.Status.Stdout
 		cmd.Stderr = cr.Status.Stderr
+		if cr.IdleTimeout > time.Duration(0) {
+			// run in its own process group to be able to kill the whole process tree,
+			// idle commands are often stuck in a child that keeps the output open
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		}
 
 		err = cmd.Start()
 		if err != nil {
 			return fmt.Errorf("unable to run command: %s", err)
 		}
 
+		done := make(chan struct{})
+		signals := make(chan os.Signal, 1)
+		if cmd.SysProcAttr != nil {
+			// the process group is no longer reached by signals to our own group,
+			// so forward them and kill the whole tree once the context is done
+			signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+			go func() {
+				for {
+					select {
+					case sig := <-signals:
+						_ = syscall.Kill(-cmd.Process.Pid, sig.(syscall.Signal))
+					case <-ctx.Done():
+						_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+						return
+					case <-done:
+						return
+					}
+				}
+			}()
+		}
+
 		err = cmd.Wait()
+		signal.Stop(signals)
+		close(done)
 		log.Debug().Err(err).Str("middleware", "runner").Msg("executed")
 
 		if err != nil {
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
@@ -84,13 +86,34 @@ func TestOutput(t *testing.T) {
 		{"echo transferred", []string{}, ""},
 		{"echo transferred error", []string{}, "transferred error\n// error: bad keyword in command output: transferred error\n"},
 
+		// jsonl tests
+		{`echo '{"level":"info","msg":"0 errors"}'`, []string{"-output-format", "jsonl"}, ""},
+		{`echo '{"level":"warn","msg":"slow"}' 1>&2`, []string{"-output-format", "jsonl"}, ""},
+		{`echo '{"level":"error","msg":"backup failed","error":"disk full"}'`, []string{"-output-format", "jsonl"}, "{\"level\":\"error\",\"msg\":\"backup failed\",\"error\":\"disk full\"}\n// error: log level error in command output: backup failed: disk full\n"},
+		{`echo '{"severity":"CRITICAL","message":"down"}' 1>&2`, []string{"-output-format", "jsonl"}, "{\"severity\":\"CRITICAL\",\"message\":\"down\"}\n// error: log level CRITICAL in command output: down\n"},
+		{"echo plain error", []string{"-output-format", "jsonl"}, "plain error\n// error: bad keyword in command output: plain error\n"},
+
+		// rule pack tests
+		{"echo sent errors.log", []string{"-rules", "rsync"}, ""},
+		{"echo sent errors.log", []string{"-rules", "rsync", "-regex", "(?i)error"}, "sent errors.log\n// error: bad keyword in command output: sent errors.log\n"},
+		{"echo 'file has vanished: /tmp/x' 1>&2; exit 24", []string{"-rules", "rsync"}, ""},
+		{"echo 'rsync error: some files could not be transferred (code 23)' 1>&2; exit 23", []string{"-rules", "rsync"}, "rsync error: some files could not be transferred (code 23)\n// error: exit status 23 (partial transfer due to error)\n"},
+		{"echo 'Saving debug log to /var/log/letsencrypt/letsencrypt.log' 1>&2", []string{"-rules", "certbot,logrotate"}, ""},
+
 		// quiet tests
 		{"false", []string{"-quiet-times", "0 * * * *:1h"}, ""},
 		{"false", []string{"-quiet-times", "0 0 * * *:0s"}, "// error: exit status 1\n"},
+		{"false", []string{"-quiet-times", "0 * * * *:1h", "-quiet-mode", "downgrade"}, "// error: exit status 1 (quiet window 0 * * * *:1h)\n"},
+		{"echo failed", []string{"-quiet-times", "0 * * * *:1h", "-quiet-mode", "skip"}, "// error: skipped during quiet window 0 * * * *:1h\n"},
 
 		// timeout tests
 		{"sleep 1", []string{"-timeout", "2s"}, ""},
 		{"sleep 2", []string{"-timeout", "500ms"}, "// error: context deadline exceeded\n"},
+
+		// idle-timeout tests
+		{"for i in 1 2 3; do sleep 0.2; echo $i; done", []string{"-idle-timeout", "500ms"}, ""},
+		{"echo hi; sleep 2", []string{"-idle-timeout", "500ms"}, "hi\n// killed: no output for 500ms\n// error: no output for 500ms\n"},
+		{"(sleep 3; echo late) & sleep 3", []string{"-idle-timeout", "500ms"}, "// killed: no output for 500ms\n// error: no output for 500ms\n"},
 	}
 	for i, c := range cases {
 		t.Logf("running case %d: %+v", i+1, c)
@@ -101,6 +124,30 @@ func TestOutput(t *testing.T) {
 		}
 	}
 
+	// idle warnings do not fail the cron, but are sent to sentry
+	events := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		events <- string(body)
+	}))
+	defer server.Close()
+	os.Setenv("CRONGUARD_SENTRY_DSN", fmt.Sprintf("http://testuser@%s/9", server.Listener.Addr().String()))
+	os.Setenv("CRONGUARD_STATE_DIR", t.TempDir())
+	err = guard(t, []string{"-idle-timeout", "500ms", "-idle-action", "warn"}, "echo hi; sleep 1", "")
+	os.Unsetenv("CRONGUARD_SENTRY_DSN")
+	os.Unsetenv("CRONGUARD_STATE_DIR")
+	if err != nil {
+		t.Error(err)
+	}
+	select {
+	case event := <-events:
+		if !strings.Contains(event, "no output for 500ms") || !strings.Contains(event, `"level":"warning"`) {
+			t.Errorf("unexpected idle warning: %s", event)
+		}
+	default:
+		t.Error("idle warning was not reported")
+	}
+
 	// paralell tests
 	cases = []tCase{
 		// lockfile tests
@@ -1,18 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"os"
-	"strconv"
-	"strings"
-	"syscall"
-	"time"
 
-	"github.com/robfig/cron"
 	"github.com/rs/xid"
 )
 
@@ -54,66 +49,89 @@ func (prefixer *uuidPrefixer) Write(p []byte) (int, error) {
 	return n, err
 }
 
-func isQuiet(cr *CmdRequest) (bool, error) {
-	if cr.QuietTimes == "" {
-		return false, nil
+// isFlagSet checks if the flag was set on the command line
+func isFlagSet(f *flag.FlagSet, name string) bool {
+	set := false
+	f.Visit(func(fl *flag.Flag) {
+		if fl.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// OutputError is returned if the command output contains a bad line
+type OutputError struct {
+	Stream string   // stdout or stderr
+	Line   string   // the bad line
+	Rule   string   // the rule that matched the line
+	Log    *logLine // the parsed line if the output format is jsonl
+	First  string   // the first bad line if there are several
+}
+
+// Error satisfies golang error
+func (e *OutputError) Error() string {
+	if e.Log != nil {
+		return fmt.Sprintf("log level %s in command output: %s", e.Log.Level, e.Log.summary())
 	}
-	ts := strings.Split(cr.QuietTimes, ":")
-	if len(ts)%2 != 0 {
-		return false, errors.New("invalid quiet-times format")
+	if e.Stream == "stderr" {
+		return "stderr is not empty"
 	}
+	return fmt.Sprintf("bad keyword in command output: %s", e.Line)
+}
 
-	for i := 0; i < len(ts); i += 2 {
-		startStr := ts[i]
-		durStr := ts[i+1]
-		now := time.Now()
-		shed, err := cron.Parse(startStr)
-		if err != nil {
-			return false, fmt.Errorf("unable to parse cron time: %s", err)
-		}
-		dur, err := time.ParseDuration(durStr)
-		if err != nil {
-			return false, fmt.Errorf("unable to parse duration: %s", err)
-		}
-		start := shed.Next(now.Add(-dur))
-		end := start.Add(dur)
-		if now.After(start) && end.After(now) {
-			return true, nil
+// checkStdoutLine validates a single line of stdout
+func checkStdoutLine(cr *CmdRequest, line []byte) *OutputError {
+	if cr.Rules.ignored(line) != nil {
+		return nil
+	}
+	if cr.OutputFormat == outputJSONL {
+		if l, ok := parseLogLine(line); ok {
+			if l.isBad() {
+				return &OutputError{Stream: "stdout", Line: string(line), Rule: "level", Log: l}
+			}
+			return nil
 		}
 	}
-	return false, nil
+	if cr.Regex != nil && cr.Regex.Match(line) {
+		return &OutputError{Stream: "stdout", Line: string(line), Rule: "regex"}
+	}
+	if matched := cr.Rules.matched(line); matched != nil {
+		return &OutputError{Stream: "stdout", Line: string(line), Rule: matched.String()}
+	}
+	return nil
 }
 
-// handleLockfile validates the lockfile and checks if the command should be run
-func handleExistingLockfile(cr *CmdRequest) (bool, error) {
-	_, statErr := os.Stat(cr.Lockfile)
-	if statErr == nil {
-		pidBytes, err := ioutil.ReadFile(cr.Lockfile)
-		if err != nil {
-			return false, fmt.Errorf("unable to read lockfile: %s", err)
-		}
-		pid, err := strconv.Atoi(string(pidBytes))
-		if err != nil {
-			return false, fmt.Errorf("unable to read pidfile: %s", err)
-		}
-		proc, err := os.FindProcess(pid)
-		if err != nil {
-			return false, fmt.Errorf("process(%d) from pidfile missing: %s", pid, err)
-		}
-		err = proc.Signal(syscall.Signal(0))
-		if err == nil {
-			_, _ = fmt.Fprintf(cr.Status.Combined, "cron is still running, pid: %d", pid)
-			return false, nil
-		} else {
-			// if we have an orphaned pid, we try to report that to our reporter and continue
-			logErr := fmt.Errorf("process(%d) from pidfile missing: %s", pid, err)
-			if cr.Reporter != nil {
-				cr.Reporter.Info(logErr)
+// checkStderrLine validates a single line of stderr
+func checkStderrLine(cr *CmdRequest, line []byte) *OutputError {
+	if cr.Rules.ignored(line) != nil {
+		return nil
+	}
+	if cr.OutputFormat == outputJSONL {
+		if l, ok := parseLogLine(line); ok {
+			if l.isBad() {
+				return &OutputError{Stream: "stderr", Line: string(line), Rule: "level", Log: l}
 			}
-			return true, nil
+			return nil
 		}
-	} else if !os.IsNotExist(statErr) {
-		return false, fmt.Errorf("unable to handle lockfile: %s", statErr)
 	}
-	return true, nil
+	if matched := cr.Rules.matched(line); matched != nil {
+		return &OutputError{Stream: "stderr", Line: string(line), Rule: matched.String()}
+	}
+	return &OutputError{Stream: "stderr", Line: string(line), Rule: "stderr"}
+}
+
+// scanLines calls f for every line in r and drains r on scanner errors
+func scanLines(r io.Reader, f func(line []byte)) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for s.Scan() {
+		f(s.Bytes())
+	}
+	if err := s.Err(); err != nil {
+		// keep reading, otherwise the writing side blocks forever
+		_, _ = io.Copy(ioutil.Discard, r)
+		return err
+	}
+	return nil
 }
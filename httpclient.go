@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type (
+	// HTTPConfig configures the transport of all outbound http integrations
+	HTTPConfig struct {
+		InsecureSkipVerify bool     `yaml:"insecure_skip_verify"`
+		CAFile             string   `yaml:"ca_file"`
+		ClientCert         string   `yaml:"client_cert"`
+		ClientKey          string   `yaml:"client_key"`
+		Proxy              string   `yaml:"proxy"`
+		Timeout            Duration `yaml:"timeout"`
+	}
+)
+
+// transport creates the http transport, the proxy defaults to the HTTP_PROXY and HTTPS_PROXY environment
+func (c HTTPConfig) transport() (*http.Transport, error) {
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if c.Proxy != "" {
+		proxyURL, err := url.Parse(c.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %s", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.Proxy = proxy
+	return transport, nil
+}
+
+// tlsConfig creates the tls config of the ca file and client certificate, it is shared with smtp
+func (c HTTPConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read ca_file: %s", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in ca_file %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.ClientCert != "" || c.ClientKey != "" {
+		if c.ClientCert == "" || c.ClientKey == "" {
+			return nil, errors.New("client_cert and client_key are both required")
+		}
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// timeout returns the configured timeout, SentryTimeout if not set
+func (c HTTPConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout)
+	}
+	return SentryTimeout
+}
+
+// httpConfig returns the http config, the defaults if there is no config
+func (c *Config) httpConfig() HTTPConfig {
+	if c == nil {
+		return HTTPConfig{}
+	}
+	return c.HTTP
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestHTTPConfig(c *check.C) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	get := func(config HTTPConfig) error {
+		transport, err := config.transport()
+		c.Assert(err, check.IsNil)
+		response, err := (&http.Client{Transport: transport, Timeout: 5 * time.Second}).Get(server.URL)
+		if err == nil {
+			response.Body.Close()
+		}
+		return err
+	}
+
+	// certificates are verified by default
+	c.Assert(get(HTTPConfig{}), check.ErrorMatches, ".*certificate.*")
+	c.Assert(get(HTTPConfig{InsecureSkipVerify: true}), check.IsNil)
+
+	caFile := filepath.Join(c.MkDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	c.Assert(ioutil.WriteFile(caFile, ca, 0644), check.IsNil)
+	c.Assert(get(HTTPConfig{CAFile: caFile}), check.IsNil)
+
+	_, err := HTTPConfig{CAFile: filepath.Join(c.MkDir(), "missing.pem")}.transport()
+	c.Assert(err, check.ErrorMatches, "unable to read ca_file: .*")
+	_, err = HTTPConfig{ClientCert: caFile}.transport()
+	c.Assert(err, check.ErrorMatches, "client_cert and client_key are both required")
+	_, err = HTTPConfig{Proxy: "http://proxy.example.com:3128"}.transport()
+	c.Assert(err, check.IsNil)
+
+	c.Assert(HTTPConfig{}.timeout(), check.Equals, SentryTimeout)
+	c.Assert(HTTPConfig{Timeout: Duration(time.Second)}.timeout(), check.Equals, time.Second)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// outputText validates the output line by line using the regex
+	outputText = "text"
+	// outputJSONL validates json log lines by their level
+	outputJSONL = "jsonl"
+)
+
+type (
+	// logLine is a structured log line, for example from zerolog, logrus or structlog
+	logLine struct {
+		Level   string
+		Message string
+		Error   string
+		Fields  map[string]interface{}
+	}
+)
+
+var (
+	// logLevelKeys are the fields that may contain the log level
+	logLevelKeys = []string{"level", "severity"}
+	// logMessageKeys are the fields that may contain the log message
+	logMessageKeys = []string{"msg", "message", "event"}
+	// logErrorKeys are the fields that may contain the error
+	logErrorKeys = []string{"error", "err"}
+
+	// badLogLevels are the levels that mark a failure
+	badLogLevels = map[string]bool{
+		"error":     true,
+		"err":       true,
+		"fatal":     true,
+		"panic":     true,
+		"crit":      true,
+		"critical":  true,
+		"alert":     true,
+		"emerg":     true,
+		"emergency": true,
+	}
+)
+
+// parseLogLine parses a json log line, ok is false if the line is not a json object
+func parseLogLine(line []byte) (l *logLine, ok bool) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 || line[0] != '{' {
+		return nil, false
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return nil, false
+	}
+	return &logLine{
+		Level:   logField(fields, logLevelKeys),
+		Message: logField(fields, logMessageKeys),
+		Error:   logField(fields, logErrorKeys),
+		Fields:  fields,
+	}, true
+}
+
+// logField returns the first of keys that is set in fields as string
+func logField(fields map[string]interface{}, keys []string) string {
+	for _, key := range keys {
+		value, ok := fields[key]
+		if !ok || value == nil {
+			continue
+		}
+		switch casted := value.(type) {
+		case string:
+			return casted
+		case float64:
+			// numeric levels as used by bunyan or pino
+			return fmt.Sprintf("%g", casted)
+		default:
+			b, _ := json.Marshal(casted)
+			return string(b)
+		}
+	}
+	return ""
+}
+
+// isBad checks if the log level marks a failure
+func (l *logLine) isBad() bool {
+	level := strings.ToLower(l.Level)
+	if badLogLevels[level] {
+		return true
+	}
+	// numeric levels: bunyan and pino use 50 for error and 60 for fatal
+	if numeric, err := strconv.ParseFloat(level, 64); err == nil {
+		return numeric >= 50
+	}
+	return false
+}
+
+// summary returns a short description of the log line
+func (l *logLine) summary() string {
+	switch {
+	case l.Message != "" && l.Error != "":
+		return fmt.Sprintf("%s: %s", l.Message, l.Error)
+	case l.Message != "":
+		return l.Message
+	default:
+		return l.Error
+	}
+}
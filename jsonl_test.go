@@ -0,0 +1,32 @@
+package main
+
+import (
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestParseLogLine(c *check.C) {
+	cases := []struct {
+		line    string
+		ok      bool
+		bad     bool
+		summary string
+	}{
+		{`plain text`, false, false, ""},
+		{`{"broken": `, false, false, ""},
+		{`{"level":"info","msg":"hello"}`, true, false, "hello"},
+		{`{"level":"error","msg":"failed","error":"disk full"}`, true, true, "failed: disk full"},
+		{`{"severity":"CRITICAL","message":"down"}`, true, true, "down"},
+		{`{"level":"warning","event":"structlog"}`, true, false, "structlog"},
+		{`{"level":30,"msg":"pino info"}`, true, false, "pino info"},
+		{`{"level":50,"msg":"pino error"}`, true, true, "pino error"},
+	}
+	for _, cse := range cases {
+		l, ok := parseLogLine([]byte(cse.line))
+		c.Assert(ok, check.Equals, cse.ok, check.Commentf("line: %s", cse.line))
+		if !ok {
+			continue
+		}
+		c.Assert(l.isBad(), check.Equals, cse.bad, check.Commentf("line: %s", cse.line))
+		c.Assert(l.summary(), check.Equals, cse.summary, check.Commentf("line: %s", cse.line))
+	}
+}
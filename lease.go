@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type (
+	// leaseLock is a shared lock with a lease that is renewed until it is released
+	leaseLock struct {
+		stale   *lockInfo
+		release func() error
+		stop    chan struct{}
+		done    chan struct{}
+		lost    chan struct{}
+	}
+)
+
+// newLeaseLock renews the lease in the background, a third of the lease before it expires.
+// renewing stops once another run took over the lock or the lease expired
+func newLeaseLock(lease time.Duration, stale *lockInfo, renew func() error, release func() error) *leaseLock {
+	l := &leaseLock{
+		stale:   stale,
+		release: release,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		lost:    make(chan struct{}),
+	}
+	go func() {
+		defer close(l.done)
+		ticker := time.NewTicker(lease / 3)
+		defer ticker.Stop()
+		renewed := time.Now()
+		for {
+			select {
+			case <-ticker.C:
+				err := renew()
+				if err == nil {
+					renewed = time.Now()
+					continue
+				}
+				if errors.Is(err, errLockLost) || time.Since(renewed) >= lease {
+					log.Error().Err(err).Msg("lock lease lost")
+					close(l.lost)
+					return
+				}
+				log.Warn().Err(err).Msg("unable to renew lock lease")
+			case <-l.stop:
+				return
+			}
+		}
+	}()
+	return l
+}
+
+// Stale satisfies the Lock interface
+func (l *leaseLock) Stale() *lockInfo {
+	return l.stale
+}
+
+// Lost satisfies the Lock interface
+func (l *leaseLock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Release satisfies the Lock interface
+func (l *leaseLock) Release() error {
+	close(l.stop)
+	<-l.done
+	return l.release()
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+type (
+	// Locker is a lock backend that ensures a cron only runs once
+	Locker interface {
+		// Acquire tries to get the lock without blocking. if the lock is held by
+		// another run, lock is nil and holder describes the other run.
+		Acquire(ctx context.Context, info lockInfo) (lock Lock, holder *lockInfo, err error)
+	}
+
+	// Lock is an acquired lock that is held until it is released
+	Lock interface {
+		// Stale returns the holder of a previous run that did not release the lock
+		Stale() *lockInfo
+		// Lost is closed if the lock was taken over by another run, nil if the lock can not be lost
+		Lost() <-chan struct{}
+		Release() error
+	}
+
+	// flockLocker locks a local lockfile using flock
+	flockLocker struct {
+		path string
+	}
+
+	// lockInfo describes the holder of a lock, it is only used for diagnostics
+	lockInfo struct {
+		PID     int       `json:"pid"`
+		Host    string    `json:"host,omitempty"`
+		Name    string    `json:"name,omitempty"`
+		Command string    `json:"command,omitempty"`
+		Started time.Time `json:"started,omitempty"`
+		Expires time.Time `json:"expires,omitempty"` // end of the lease for shared backends
+		Token   string    `json:"token,omitempty"`   // identifies the run for shared backends
+	}
+
+	// fileLock is a flock on a lockfile that is held for the lifetime of the run
+	fileLock struct {
+		file  *os.File
+		stale *lockInfo // holder of a previous run that did not release the lock
+	}
+)
+
+// lock backends
+const (
+	lockFlock = "flock"
+	lockDir   = "dir"
+	lockRedis = "redis"
+)
+
+// newLocker returns the configured lock backend for the lockfile
+func newLocker(cr *CmdRequest) (Locker, error) {
+	// the shared backends use the base name of the lockfile as lock name
+	name := strings.TrimSuffix(filepath.Base(cr.Lockfile), ".lock")
+	locks := cr.Config.Locks
+	switch cr.LockBackend {
+	case lockFlock, "":
+		return &flockLocker{path: cr.Lockfile}, nil
+	case lockDir:
+		if locks.Dir == "" {
+			return nil, errors.New("lock backend 'dir' requires locks.dir in the config")
+		}
+		return &dirLocker{path: filepath.Join(locks.Dir, name+".lock"), lease: locks.lease()}, nil
+	case lockRedis:
+		if locks.Redis == "" {
+			return nil, errors.New("lock backend 'redis' requires locks.redis in the config")
+		}
+		return &redisLocker{
+			addr:     locks.Redis,
+			password: locks.RedisPassword,
+			db:       locks.RedisDB,
+			key:      "cronguard:lock:" + name,
+			lease:    locks.lease(),
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid lock-backend: '%s'", cr.LockBackend)
+	}
+}
+
+// newLockInfo describes the current run
+func newLockInfo(cr *CmdRequest) lockInfo {
+	hostname, _ := os.Hostname()
+	return lockInfo{
+		PID:     os.Getpid(),
+		Host:    hostname,
+		Name:    cr.Name,
+		Command: cr.Command,
+		Started: time.Now(),
+		Token:   xid.New().String(),
+	}
+}
+
+// remoteHost returns the host of the holder if it is not the local host
+func (i *lockInfo) remoteHost() string {
+	hostname, _ := os.Hostname()
+	if i.Host == hostname {
+		return ""
+	}
+	return i.Host
+}
+
+// pid returns the pid of the holder, unknown if the lockfile had none
+func (i *lockInfo) pid() string {
+	if i.PID <= 0 {
+		return "unknown"
+	}
+	return strconv.Itoa(i.PID)
+}
+
+// Acquire satisfies the Locker interface
+func (l *flockLocker) Acquire(ctx context.Context, info lockInfo) (Lock, *lockInfo, error) {
+	lock, holder, err := acquireFileLock(l.path, info)
+	if lock == nil {
+		// avoid a non-nil interface holding a nil pointer
+		return nil, holder, err
+	}
+	return lock, holder, err
+}
+
+// acquireFileLock tries to lock path without blocking. if the lock is held by
+// another run, lock is nil and holder describes the other run.
+func acquireFileLock(path string, info lockInfo) (lock *fileLock, holder *lockInfo, err error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open lockfile: %s", err)
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		holder, _ = readLockInfo(file)
+		file.Close()
+		if holder == nil {
+			holder = &lockInfo{}
+		}
+		return nil, holder, nil
+	}
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("unable to lock lockfile: %s", err)
+	}
+
+	// a released lockfile is empty, otherwise the previous run crashed
+	lock = &fileLock{file: file}
+	lock.stale, _ = readLockInfo(file)
+	if err := lock.write(info); err != nil {
+		lock.Release()
+		return nil, nil, err
+	}
+	return lock, nil, nil
+}
+
+// write replaces the diagnostic information in the lockfile
+func (l *fileLock) write(info lockInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err := l.file.Truncate(0); err != nil {
+		return fmt.Errorf("unable to write lockfile: %s", err)
+	}
+	if _, err := l.file.WriteAt(append(data, '\n'), 0); err != nil {
+		return fmt.Errorf("unable to write lockfile: %s", err)
+	}
+	return nil
+}
+
+// Stale satisfies the Lock interface
+func (l *fileLock) Stale() *lockInfo {
+	return l.stale
+}
+
+// Lost satisfies the Lock interface, a flock is held until the file is closed
+func (l *fileLock) Lost() <-chan struct{} {
+	return nil
+}
+
+// Release empties the lockfile and releases the lock. the file is not removed,
+// otherwise a waiting run could lock the removed file while another run creates a new one
+func (l *fileLock) Release() error {
+	_ = l.file.Truncate(0)
+	return l.file.Close()
+}
+
+// readLockInfo reads the holder from a lockfile, nil if the lockfile is empty
+func readLockInfo(r io.ReaderAt) (*lockInfo, error) {
+	data, err := ioutil.ReadAll(io.NewSectionReader(r, 0, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	content := strings.TrimSpace(string(data))
+	if content == "" {
+		return nil, nil
+	}
+	info := &lockInfo{}
+	if err := json.Unmarshal([]byte(content), info); err == nil {
+		return info, nil
+	}
+	// lockfiles of older cronguard versions only contain the pid
+	pid, err := strconv.Atoi(content)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse lockfile: %s", err)
+	}
+	return &lockInfo{PID: pid}, nil
+}
+
+// lockPollInterval is the interval to retry a held lock while waiting
+var lockPollInterval = 250 * time.Millisecond
+
+// LockWaitError is returned if the lock was not released within the lock wait time
+type LockWaitError struct {
+	Wait   time.Duration
+	Holder *lockInfo
+}
+
+// Error satisfies the error interface
+func (e *LockWaitError) Error() string {
+	return fmt.Sprintf("lock wait timed out after %s, pid: %s", e.Wait, e.Holder.pid())
+}
+
+// waitLock retries to get the lock until it is released or wait expires
+func waitLock(ctx context.Context, locker Locker, info lockInfo, wait time.Duration) (Lock, error) {
+	deadline := time.After(wait)
+	ticker := time.NewTicker(lockPollInterval)
+	defer ticker.Stop()
+	for {
+		lock, holder, err := locker.Acquire(ctx, info)
+		if err != nil || lock != nil {
+			return lock, err
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return nil, &LockWaitError{Wait: wait, Holder: holder}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// StuckLockError describes a lock holder that blocks the cron for too long
+type StuckLockError struct {
+	Holder  *lockInfo
+	Cmdline string
+	Skipped int
+	Age     time.Duration
+}
+
+// Error satisfies the error interface
+func (e *StuckLockError) Error() string {
+	started := "unknown"
+	if !e.Holder.Started.IsZero() {
+		started = fmt.Sprintf("%s (running %s)", e.Holder.Started.Format(time.RFC3339), e.Age.Round(time.Second))
+	}
+	return fmt.Sprintf(
+		"lock held by pid %s since %s, %d runs skipped: %s",
+		e.Holder.pid(), started, e.Skipped, e.Cmdline,
+	)
+}
+
+// checkStuckLock counts the skipped run and returns an error if the holder
+// blocks the cron longer than the configured thresholds. the error is only
+// returned once until the cron gets the lock again
+func checkStuckLock(cr *CmdRequest, holder *lockInfo, now time.Time) (*StuckLockError, error) {
+	stuck := &StuckLockError{Holder: holder}
+	if !holder.Started.IsZero() {
+		stuck.Age = now.Sub(holder.Started)
+	}
+	alert := false
+	_, err := updateJobState(cr.Config, cr.stateName(), func(state *jobState) {
+		state.SkippedRuns++
+		state.LastSkip = now
+		stuck.Skipped = state.SkippedRuns
+		switch {
+		case state.StuckAlerted:
+		case cr.LockAlertSkips > 0 && stuck.Skipped >= cr.LockAlertSkips:
+			alert = true
+		case cr.LockAlertAge > 0 && stuck.Age > cr.LockAlertAge:
+			alert = true
+		}
+		if alert {
+			state.StuckAlerted = true
+		}
+	})
+	if err != nil || !alert {
+		return nil, err
+	}
+	stuck.Cmdline = holderCmdline(holder)
+	return stuck, nil
+}
+
+// resetSkippedRuns resets the skip counter and the alert once the cron got the lock
+func resetSkippedRuns(cr *CmdRequest) error {
+	state, err := loadJobState(cr.Config, cr.stateName())
+	if err != nil || (state.SkippedRuns == 0 && !state.StuckAlerted) {
+		return err
+	}
+	state.SkippedRuns = 0
+	state.StuckAlerted = false
+	return writeJobState(cr.Config, cr.stateName(), state)
+}
+
+// holderCmdline returns the command line of the holder from /proc, falls back to the command from the lockfile
+func holderCmdline(holder *lockInfo) string {
+	hostname, _ := os.Hostname()
+	if holder.PID > 0 && (holder.Host == "" || holder.Host == hostname) {
+		data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", holder.PID))
+		if err == nil && len(data) > 0 {
+			return strings.TrimSpace(strings.ReplaceAll(string(data), "\x00", " "))
+		}
+	}
+	return holder.Command
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestFileLock(c *check.C) {
+	path := filepath.Join(c.MkDir(), "guard.lock")
+	info := lockInfo{PID: 42, Name: "first"}
+
+	lock, holder, err := acquireFileLock(path, info)
+	c.Assert(err, check.IsNil)
+	c.Assert(holder, check.IsNil)
+	c.Assert(lock, check.NotNil)
+	c.Assert(lock.stale, check.IsNil)
+
+	// a second run is blocked and sees the holder
+	second, holder, err := acquireFileLock(path, lockInfo{PID: 43, Name: "second"})
+	c.Assert(err, check.IsNil)
+	c.Assert(second, check.IsNil)
+	c.Assert(holder, check.NotNil)
+	c.Assert(holder.PID, check.Equals, 42)
+	c.Assert(holder.Name, check.Equals, "first")
+
+	// the lockfile is kept but emptied on release
+	c.Assert(lock.Release(), check.IsNil)
+	content, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(content, check.HasLen, 0)
+
+	second, _, err = acquireFileLock(path, lockInfo{PID: 43, Name: "second"})
+	c.Assert(err, check.IsNil)
+	c.Assert(second, check.NotNil)
+	c.Assert(second.stale, check.IsNil)
+	c.Assert(second.Release(), check.IsNil)
+
+	// leftovers of a crashed run or an older version are stale
+	c.Assert(ioutil.WriteFile(path, []byte("1234"), 0600), check.IsNil)
+	lock, _, err = acquireFileLock(path, info)
+	c.Assert(err, check.IsNil)
+	c.Assert(lock, check.NotNil)
+	c.Assert(lock.stale, check.DeepEquals, &lockInfo{PID: 1234})
+	c.Assert(lock.Release(), check.IsNil)
+}
+
+func (s *Suite) TestWaitFileLock(c *check.C) {
+	path := filepath.Join(c.MkDir(), "guard.lock")
+	lock, _, err := acquireFileLock(path, lockInfo{PID: 42})
+	c.Assert(err, check.IsNil)
+
+	_, err = waitLock(context.Background(), &flockLocker{path: path}, lockInfo{PID: 43}, 100*time.Millisecond)
+	c.Assert(err, check.FitsTypeOf, &LockWaitError{})
+	c.Assert(err, check.ErrorMatches, "lock wait timed out after 100ms, pid: 42")
+
+	go func() {
+		<-time.After(300 * time.Millisecond)
+		lock.Release()
+	}()
+	second, err := waitLock(context.Background(), &flockLocker{path: path}, lockInfo{PID: 43}, 5*time.Second)
+	c.Assert(err, check.IsNil)
+	c.Assert(second, check.NotNil)
+	c.Assert(second.Release(), check.IsNil)
+}
+
+func (s *Suite) TestCheckStuckLock(c *check.C) {
+	os.Setenv("CRONGUARD_STATE_DIR", c.MkDir())
+	defer os.Unsetenv("CRONGUARD_STATE_DIR")
+	now := time.Now()
+	holder := &lockInfo{PID: os.Getpid(), Command: "sleep 3600", Started: now.Add(-2 * time.Hour)}
+	cr := &CmdRequest{Config: &Config{}, Name: "backup", LockAlertSkips: 3}
+
+	for i := 1; i < 3; i++ {
+		stuck, err := checkStuckLock(cr, holder, now)
+		c.Assert(err, check.IsNil)
+		c.Assert(stuck, check.IsNil)
+	}
+	stuck, err := checkStuckLock(cr, holder, now)
+	c.Assert(err, check.IsNil)
+	c.Assert(stuck, check.NotNil)
+	c.Assert(stuck.Skipped, check.Equals, 3)
+	c.Assert(stuck.Age, check.Equals, 2*time.Hour)
+	c.Assert(stuck.Cmdline, check.Not(check.Equals), "")
+	c.Assert(stuck, check.ErrorMatches, "lock held by pid [0-9]+ since .* \\(running 2h0m0s\\), 3 runs skipped: .*")
+
+	// the alert is only sent once
+	stuck, err = checkStuckLock(cr, holder, now)
+	c.Assert(err, check.IsNil)
+	c.Assert(stuck, check.IsNil)
+
+	// the counter is reset once the cron gets the lock
+	c.Assert(resetSkippedRuns(cr), check.IsNil)
+	state, err := loadJobState(cr.Config, cr.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(state.SkippedRuns, check.Equals, 0)
+
+	// a lock that is held too long is reported on the first skip
+	cr.LockAlertSkips = 0
+	cr.LockAlertAge = time.Hour
+	holder = &lockInfo{PID: 0, Command: "sleep 3600", Started: now.Add(-2 * time.Hour)}
+	stuck, err = checkStuckLock(cr, holder, now)
+	c.Assert(err, check.IsNil)
+	c.Assert(stuck, check.NotNil)
+	c.Assert(stuck.Cmdline, check.Equals, "sleep 3600")
+	c.Assert(stuck, check.ErrorMatches, "lock held by pid unknown since .*")
+}
+
+func (s *Suite) TestLockfileSkipped(c *check.C) {
+	dir := c.MkDir()
+	// the holder did not record its pid
+	locker := &dirLocker{path: filepath.Join(dir, "backup.lock"), lease: time.Hour}
+	other, _, err := locker.Acquire(context.Background(), lockInfo{Token: "other"})
+	c.Assert(err, check.IsNil)
+	defer other.Release()
+	notifier := &mockNotifier{}
+	reporter := newMockReporter(namedNotifier{Notifier: notifier, name: "mock", timeout: time.Second})
+
+	for i := 0; i < 2; i++ {
+		combined := &bytes.Buffer{}
+		cr := &CmdRequest{
+			Name:           "backup",
+			Lockfile:       filepath.Join(dir, "backup.lock"),
+			LockBackend:    lockDir,
+			LockAlertSkips: 1,
+			Config:         &Config{Locks: LockConfig{Dir: dir}},
+			Status:         &CmdStatus{Combined: combined},
+			Reporter:       reporter,
+		}
+		err := lockfile(func(ctx context.Context, cr *CmdRequest) error {
+			c.Fatal("cron ran while the lock is held")
+			return nil
+		})(context.Background(), cr)
+		c.Assert(err, check.IsNil)
+		c.Assert(combined.String(), check.Equals, "cron is still running, pid: unknown\n")
+	}
+	// the stuck lock is reported on the first skip only
+	c.Assert(notifier.results, check.HasLen, 1)
+	c.Assert(notifier.results[0].Err, check.ErrorMatches, "lock held by pid unknown since unknown, 1 runs skipped: ")
+}
+
+func (s *Suite) TestDirLock(c *check.C) {
+	path := filepath.Join(c.MkDir(), "backup.lock")
+	first := &dirLocker{path: path, lease: 300 * time.Millisecond}
+	second := &dirLocker{path: path, lease: 300 * time.Millisecond}
+
+	lock, holder, err := first.Acquire(context.Background(), lockInfo{PID: 42, Host: "node-1", Token: "first"})
+	c.Assert(err, check.IsNil)
+	c.Assert(holder, check.IsNil)
+	c.Assert(lock, check.NotNil)
+
+	// the lease is renewed while the lock is held
+	<-time.After(time.Second)
+	other, holder, err := second.Acquire(context.Background(), lockInfo{PID: 43, Host: "node-2", Token: "second"})
+	c.Assert(err, check.IsNil)
+	c.Assert(other, check.IsNil)
+	c.Assert(holder.Host, check.Equals, "node-1")
+
+	c.Assert(lock.Release(), check.IsNil)
+	crashed := &dirLocker{path: path, lease: time.Hour}
+	other, _, err = crashed.Acquire(context.Background(), lockInfo{PID: 43, Host: "node-2", Token: "second"})
+	c.Assert(err, check.IsNil)
+	c.Assert(other, check.NotNil)
+	c.Assert(other.Stale(), check.IsNil)
+
+	// an expired lease of a crashed run is taken over
+	c.Assert(crashed.write(lockInfo{PID: 43, Host: "node-2", Token: "second", Expires: time.Now().Add(-time.Second)}), check.IsNil)
+	lock, _, err = first.Acquire(context.Background(), lockInfo{PID: 44, Host: "node-1", Token: "third"})
+	c.Assert(err, check.IsNil)
+	c.Assert(lock, check.NotNil)
+	c.Assert(lock.Stale().Token, check.Equals, "second")
+	c.Assert(other.Release(), check.Equals, errLockLost)
+	c.Assert(lock.Release(), check.IsNil)
+}
+
+func (s *Suite) TestLostLock(c *check.C) {
+	path := filepath.Join(c.MkDir(), "backup.lock")
+	locker := &dirLocker{path: path, lease: 300 * time.Millisecond}
+	lock, _, err := locker.Acquire(context.Background(), lockInfo{PID: 42, Token: "first"})
+	c.Assert(err, check.IsNil)
+
+	// another run took over the lock, renewing stops
+	c.Assert(locker.write(lockInfo{PID: 43, Token: "second", Expires: time.Now().Add(time.Hour)}), check.IsNil)
+	select {
+	case <-lock.Lost():
+	case <-time.After(time.Second):
+		c.Fatal("lost lock not detected")
+	}
+	c.Assert(lock.Release(), check.Equals, errLockLost)
+}
+
+func (s *Suite) TestLockfileLost(c *check.C) {
+	dir := c.MkDir()
+	cr := &CmdRequest{
+		Name:        "backup",
+		Lockfile:    filepath.Join(dir, "backup.lock"),
+		LockBackend: lockDir,
+		Config:      &Config{Locks: LockConfig{Dir: dir, Lease: Duration(300 * time.Millisecond)}},
+		Status:      &CmdStatus{Combined: ioutil.Discard},
+	}
+	locker := &dirLocker{path: filepath.Join(dir, "backup.lock"), lease: time.Hour}
+	err := lockfile(func(ctx context.Context, cr *CmdRequest) error {
+		c.Assert(locker.write(lockInfo{PID: 43, Token: "other", Expires: time.Now().Add(time.Hour)}), check.IsNil)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			return nil
+		}
+	})(context.Background(), cr)
+	c.Assert(err, check.Equals, errLockLost)
+	c.Assert(cr.Status.Killed, check.Equals, errLockLost.Error())
+}
+
+func (s *Suite) TestLockfileLostWithTimeout(c *check.C) {
+	dir := c.MkDir()
+	cr := &CmdRequest{
+		Name:        "backup",
+		Command:     "sleep 3",
+		Timeout:     time.Minute,
+		Lockfile:    filepath.Join(dir, "backup.lock"),
+		LockBackend: lockDir,
+		Config:      &Config{Locks: LockConfig{Dir: dir, Lease: Duration(300 * time.Millisecond)}},
+		Status:      &CmdStatus{Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}, Combined: ioutil.Discard},
+	}
+	locker := &dirLocker{path: filepath.Join(dir, "backup.lock"), lease: time.Hour}
+	start := time.Now()
+	err := lockfile(func(ctx context.Context, cr *CmdRequest) error {
+		c.Assert(locker.write(lockInfo{PID: 43, Token: "other", Expires: time.Now().Add(time.Hour)}), check.IsNil)
+		return timeout(runner())(ctx, cr)
+	})(context.Background(), cr)
+	// the timeout does not keep the command running after the lease was lost
+	c.Assert(time.Since(start) < 2*time.Second, check.Equals, true)
+	c.Assert(err, check.Equals, errLockLost)
+}
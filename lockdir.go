@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+type (
+	// dirLocker locks a directory on a shared filesystem, mkdir is atomic even on NFS
+	dirLocker struct {
+		path  string
+		lease time.Duration
+	}
+)
+
+// errLockLost is returned if a lease expired and another run took over the lock
+var errLockLost = errors.New("lock was taken over by another run")
+
+// Acquire satisfies the Locker interface
+func (l *dirLocker) Acquire(ctx context.Context, info lockInfo) (Lock, *lockInfo, error) {
+	var stale *lockInfo
+	err := os.Mkdir(l.path, 0755)
+	if errors.Is(err, os.ErrExist) {
+		holder, holderErr := l.holder()
+		if holderErr != nil {
+			return nil, nil, holderErr
+		}
+		if time.Now().Before(holder.Expires) {
+			return nil, holder, nil
+		}
+		// the lease expired, the holder crashed or lost the shared filesystem
+		if err := l.breakLock(holder); err != nil {
+			return nil, nil, err
+		}
+		stale = holder
+		err = os.Mkdir(l.path, 0755)
+		if errors.Is(err, os.ErrExist) {
+			// another run was faster
+			holder, err := l.holder()
+			return nil, holder, err
+		}
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create lock directory: %s", err)
+	}
+
+	info.Expires = time.Now().Add(l.lease)
+	if err := l.write(info); err != nil {
+		_ = os.RemoveAll(l.path)
+		return nil, nil, err
+	}
+	renew := func() error {
+		holder, err := l.holder()
+		if err != nil {
+			return err
+		}
+		if holder.Token != info.Token {
+			return errLockLost
+		}
+		info.Expires = time.Now().Add(l.lease)
+		return l.write(info)
+	}
+	release := func() error {
+		holder, err := l.holder()
+		if err != nil || holder.Token != info.Token {
+			return errLockLost
+		}
+		return os.RemoveAll(l.path)
+	}
+	return newLeaseLock(l.lease, stale, renew, release), nil, nil
+}
+
+// holder reads the holder of the lock directory. a directory without
+// information was just created, it only expires after the lease time
+func (l *dirLocker) holder() (*lockInfo, error) {
+	holder := &lockInfo{}
+	data, err := ioutil.ReadFile(filepath.Join(l.path, "info.json"))
+	if err == nil {
+		if err := json.Unmarshal(data, holder); err != nil {
+			return nil, fmt.Errorf("unable to parse lock directory: %s", err)
+		}
+		return holder, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("unable to read lock directory: %s", err)
+	}
+	stat, err := os.Stat(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		// released in the meantime, retried on the next attempt
+		holder.Expires = time.Now().Add(l.lease)
+		return holder, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read lock directory: %s", err)
+	}
+	holder.Expires = stat.ModTime().Add(l.lease)
+	return holder, nil
+}
+
+// write replaces the information in the lock directory atomically
+func (l *dirLocker) write(info lockInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(l.path, "info.json")
+	tmp := fmt.Sprintf("%s.%s", path, info.Token)
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("unable to write lock directory: %s", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// breakLock removes an expired lock directory. it is moved away first, if
+// another run broke the lock and took over in the meantime it is moved back
+func (l *dirLocker) breakLock(holder *lockInfo) error {
+	broken := fmt.Sprintf("%s.%s.expired", l.path, xid.New().String())
+	err := os.Rename(l.path, broken)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to remove expired lock directory: %s", err)
+	}
+	moved := &dirLocker{path: broken, lease: l.lease}
+	if current, err := moved.holder(); err == nil && current.Token != holder.Token {
+		_ = os.Rename(broken, l.path)
+		return nil
+	}
+	return os.RemoveAll(broken)
+}
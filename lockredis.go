@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+type (
+	// redisLocker locks a key in redis using SET NX PX with a renewed lease
+	redisLocker struct {
+		addr     string
+		password string
+		db       int
+		key      string
+		lease    time.Duration
+	}
+)
+
+const (
+	// redisRenewScript extends the lease if the lock is still held by the run
+	redisRenewScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+	// redisReleaseScript deletes the lock if it is still held by the run
+	redisReleaseScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+)
+
+// Acquire satisfies the Locker interface
+func (l *redisLocker) Acquire(ctx context.Context, info lockInfo) (Lock, *lockInfo, error) {
+	conn, err := dialRedis(ctx, l.addr, l.password, l.db)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	value := string(data)
+	lease := strconv.FormatInt(l.lease.Milliseconds(), 10)
+	reply, err := conn.do("SET", l.key, value, "NX", "PX", lease)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if reply == nil {
+		defer conn.Close()
+		holder := &lockInfo{}
+		reply, err := conn.do("GET", l.key)
+		if err != nil {
+			return nil, nil, err
+		}
+		// the lock may have been released in the meantime, it is retried on the next attempt
+		if current, ok := reply.(string); ok {
+			_ = json.Unmarshal([]byte(current), holder)
+		}
+		return nil, holder, nil
+	}
+
+	script := func(script string, args ...string) error {
+		reply, err := conn.do(append([]string{"EVAL", script, "1", l.key, value}, args...)...)
+		if err != nil {
+			// reconnect once, the connection is idle most of the time
+			conn.Close()
+			reconnected, err := dialRedis(context.Background(), l.addr, l.password, l.db)
+			if err != nil {
+				return err
+			}
+			conn = reconnected
+			if reply, err = conn.do(append([]string{"EVAL", script, "1", l.key, value}, args...)...); err != nil {
+				return err
+			}
+		}
+		if reply != int64(1) {
+			return errLockLost
+		}
+		return nil
+	}
+	renew := func() error {
+		return script(redisRenewScript, lease)
+	}
+	release := func() error {
+		// script may have replaced the connection
+		defer func() { conn.Close() }()
+		return script(redisReleaseScript)
+	}
+	// expired keys vanish, a crashed run can not be detected
+	return newLeaseLock(l.lease, nil, renew, release), nil, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+// fakeRedis implements the redis commands used by the redis lock backend
+type fakeRedis struct {
+	sync.Mutex
+	listener net.Listener
+	values   map[string]string
+	expires  map[string]time.Time
+	conns    map[net.Conn]bool
+}
+
+func newFakeRedis(c *check.C) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	f := &fakeRedis{listener: listener, values: map[string]string{}, expires: map[string]time.Time{}, conns: map[net.Conn]bool{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	f.Lock()
+	f.conns[conn] = true
+	f.Unlock()
+	defer func() {
+		f.Lock()
+		delete(f.conns, conn)
+		f.Unlock()
+		conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	for {
+		request, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		args := []string{}
+		for _, arg := range request.([]interface{}) {
+			args = append(args, arg.(string))
+		}
+		fmt.Fprint(conn, f.handle(args))
+	}
+}
+
+// open returns the number of client connections
+func (f *fakeRedis) open() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.conns)
+}
+
+// drop closes all client connections like an idle timeout of the server
+func (f *fakeRedis) drop() {
+	f.Lock()
+	defer f.Unlock()
+	for conn := range f.conns {
+		conn.Close()
+	}
+}
+
+func (f *fakeRedis) handle(args []string) string {
+	f.Lock()
+	defer f.Unlock()
+	for key, expires := range f.expires {
+		if time.Now().After(expires) {
+			delete(f.values, key)
+			delete(f.expires, key)
+		}
+	}
+	switch {
+	case args[0] == "SET" && len(args) == 6:
+		if _, ok := f.values[args[1]]; ok {
+			return "$-1\r\n"
+		}
+		ms, _ := strconv.Atoi(args[5])
+		f.values[args[1]] = args[2]
+		f.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return "+OK\r\n"
+	case args[0] == "GET":
+		value, ok := f.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case args[0] == "EVAL" && args[1] == redisRenewScript:
+		if f.values[args[3]] != args[4] {
+			return ":0\r\n"
+		}
+		ms, _ := strconv.Atoi(args[5])
+		f.expires[args[3]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+	case args[0] == "EVAL" && args[1] == redisReleaseScript:
+		if f.values[args[3]] != args[4] {
+			return ":0\r\n"
+		}
+		delete(f.values, args[3])
+		delete(f.expires, args[3])
+		return ":1\r\n"
+	default:
+		return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+	}
+}
+
+func (s *Suite) TestRedisLock(c *check.C) {
+	redis := newFakeRedis(c)
+	defer redis.listener.Close()
+	addr := redis.listener.Addr().String()
+	first := &redisLocker{addr: addr, key: "cronguard:lock:backup", lease: 300 * time.Millisecond}
+	second := &redisLocker{addr: addr, key: "cronguard:lock:backup", lease: 300 * time.Millisecond}
+
+	lock, holder, err := first.Acquire(context.Background(), lockInfo{PID: 42, Host: "node-1", Token: "first"})
+	c.Assert(err, check.IsNil)
+	c.Assert(holder, check.IsNil)
+	c.Assert(lock, check.NotNil)
+
+	// the lease is renewed while the lock is held
+	<-time.After(time.Second)
+	other, holder, err := second.Acquire(context.Background(), lockInfo{PID: 43, Host: "node-2", Token: "second"})
+	c.Assert(err, check.IsNil)
+	c.Assert(other, check.IsNil)
+	c.Assert(holder.Host, check.Equals, "node-1")
+	c.Assert(holder.remoteHost(), check.Equals, "node-1")
+
+	c.Assert(lock.Release(), check.IsNil)
+	other, _, err = second.Acquire(context.Background(), lockInfo{PID: 43, Host: "node-2", Token: "second"})
+	c.Assert(err, check.IsNil)
+	c.Assert(other, check.NotNil)
+	c.Assert(other.Release(), check.IsNil)
+}
+
+func (s *Suite) TestRedisLockReconnect(c *check.C) {
+	redis := newFakeRedis(c)
+	defer redis.listener.Close()
+	locker := &redisLocker{addr: redis.listener.Addr().String(), key: "cronguard:lock:backup", lease: time.Hour}
+	lock, _, err := locker.Acquire(context.Background(), lockInfo{Token: "first"})
+	c.Assert(err, check.IsNil)
+
+	// the release reconnects and closes the new connection
+	redis.drop()
+	c.Assert(lock.Release(), check.IsNil)
+	for i := 0; i < 20 && redis.open() > 0; i++ {
+		<-time.After(50 * time.Millisecond)
+	}
+	c.Assert(redis.open(), check.Equals, 0)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// unsafeLockName matches the characters that are replaced in lock names
+var unsafeLockName = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// lockPath derives the lockfile of a cron from its name. names that had to be
+// changed get a hash suffix, so different names never share a lockfile
+func lockPath(c *Config, name string) string {
+	safe := unsafeLockName.ReplaceAllString(name, "_")
+	if safe != name {
+		sum := sha256.Sum256([]byte(name))
+		safe = fmt.Sprintf("%s-%s", safe, hex.EncodeToString(sum[:4]))
+	}
+	return filepath.Join(c.runtimeDir(), "locks", safe+".lock")
+}
+
+// procLocks lists the file locks of all processes
+var procLocks = "/proc/locks"
+
+// readFileLock reads the holder of a lockfile, held is false if the lock is free. the
+// lock is looked up in /proc/locks, testing it would make a starting cron skip its run
+func readFileLock(path string) (holder *lockInfo, held bool, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+	held, err = isFlocked(file)
+	if err != nil || !held {
+		return nil, false, err
+	}
+	holder, err = readLockInfo(file)
+	if holder == nil {
+		holder = &lockInfo{}
+	}
+	return holder, true, err
+}
+
+// isFlocked checks if there is a flock on the file in /proc/locks
+func isFlocked(file *os.File) (bool, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, errors.New("unable to stat lockfile")
+	}
+	dev := uint64(stat.Dev)
+	major := (dev>>8)&0xfff | (dev>>32)&^uint64(0xfff)
+	minor := dev&0xff | (dev>>12)&^uint64(0xff)
+	id := fmt.Sprintf("%02x:%02x:%d", major, minor, stat.Ino)
+
+	data, err := ioutil.ReadFile(procLocks)
+	if err != nil {
+		return false, fmt.Errorf("unable to read locks: %s", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// 1: FLOCK  ADVISORY  WRITE 1234 fe:00:9620017 0 EOF, waiters are marked with ->
+		fields := strings.Fields(line)
+		if len(fields) < 6 || fields[1] != "FLOCK" {
+			continue
+		}
+		if fields[5] == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// locksCmd lists the holders of the locks and semaphore slots in the runtime directory
+func locksCmd(args []string) error {
+	f := flag.NewFlagSet("locks", flag.ExitOnError)
+	all := f.Bool("all", false, "include free locks")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	config := ParseConfig()
+	dir := config.runtimeDir()
+	paths := []string{}
+	for _, pattern := range []string{"locks/*.lock", "semaphores/*.lock"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return err
+		}
+		paths = append(paths, matches...)
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "LOCK\tPID\tHOST\tAGE\tNAME\tCOMMAND\n")
+	for _, path := range paths {
+		lock := strings.TrimSuffix(strings.TrimPrefix(path, dir+string(filepath.Separator)), ".lock")
+		holder, held, err := readFileLock(path)
+		if err != nil {
+			return fmt.Errorf("unable to read lock %s: %s", lock, err)
+		}
+		if !held {
+			if *all {
+				fmt.Fprintf(w, "%s\t-\t-\t-\t-\t-\n", lock)
+			}
+			continue
+		}
+		age := "unknown"
+		if !holder.Started.IsZero() {
+			age = now.Sub(holder.Started).Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", lock, holder.PID, holder.Host, age, holder.Name, holder.Command)
+	}
+	return w.Flush()
+}
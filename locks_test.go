@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestLockPath(c *check.C) {
+	config := &Config{RuntimeDir: "/run/cronguard"}
+	c.Assert(lockPath(config, "backup-db"), check.Equals, "/run/cronguard/locks/backup-db.lock")
+	c.Assert(lockPath(config, "../backup db"), check.Matches, "/run/cronguard/locks/_backup_db-[0-9a-f]{8}\\.lock")
+	c.Assert(lockPath(config, "backup/db"), check.Not(check.Equals), lockPath(config, "backup_db"))
+}
+
+func (s *Suite) TestReadFileLock(c *check.C) {
+	path := filepath.Join(c.MkDir(), "backup.lock")
+	_, _, err := readFileLock(path)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+
+	lock, _, err := acquireFileLock(path, lockInfo{PID: 42, Host: "node-1"})
+	c.Assert(err, check.IsNil)
+	holder, held, err := readFileLock(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(held, check.Equals, true)
+	c.Assert(holder.PID, check.Equals, 42)
+
+	c.Assert(lock.Release(), check.IsNil)
+	holder, held, err = readFileLock(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(held, check.Equals, false)
+	c.Assert(holder, check.IsNil)
+
+	// reading does not take the lock
+	lock, _, err = acquireFileLock(path, lockInfo{PID: 43})
+	c.Assert(err, check.IsNil)
+	c.Assert(lock, check.NotNil)
+	c.Assert(lock.Release(), check.IsNil)
+}
+
+func (s *Suite) TestIsFlocked(c *check.C) {
+	file, err := os.Create(filepath.Join(c.MkDir(), "backup.lock"))
+	c.Assert(err, check.IsNil)
+	defer file.Close()
+	info, err := file.Stat()
+	c.Assert(err, check.IsNil)
+	stat := info.Sys().(*syscall.Stat_t)
+	dev := uint64(stat.Dev)
+	id := fmt.Sprintf("%02x:%02x:%d", (dev>>8)&0xfff|(dev>>32)&^uint64(0xfff), dev&0xff|(dev>>12)&^uint64(0xff), stat.Ino)
+
+	defer func(path string) { procLocks = path }(procLocks)
+	procLocks = filepath.Join(c.MkDir(), "locks")
+	write := func(locks string) {
+		c.Assert(ioutil.WriteFile(procLocks, []byte(locks), 0o644), check.IsNil)
+	}
+
+	write("1: POSIX  ADVISORY  WRITE 42 " + id + " 0 EOF\n2: FLOCK  ADVISORY  WRITE 42 00:00:1 0 EOF\n")
+	held, err := isFlocked(file)
+	c.Assert(err, check.IsNil)
+	c.Assert(held, check.Equals, false)
+
+	write("1: FLOCK  ADVISORY  WRITE 42 " + id + " 0 EOF\n1: -> FLOCK  ADVISORY  WRITE 43 " + id + " 0 EOF\n")
+	held, err = isFlocked(file)
+	c.Assert(err, check.IsNil)
+	c.Assert(held, check.Equals, true)
+
+	procLocks = filepath.Join(c.MkDir(), "missing")
+	_, err = isFlocked(file)
+	c.Assert(err, check.ErrorMatches, "unable to read locks: .*")
+}
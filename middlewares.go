@@ -1,14 +1,13 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
-	"errors"
 	"fmt"
 	"io"
 	"log/syslog"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -67,6 +66,7 @@ func insertUUID(g GuardFunc) GuardFunc {
 		}
 		combined := newUUIDPrefixer(cr.Status.Combined)
 		cr.Status.Combined = combined
+		cr.Status.UUID = strings.TrimSpace(string(combined.uuid))
 		err = g(ctx, cr)
 		log.Debug().Err(err).Str("middleware", "insertUUID").Msg("executed")
 		return err
@@ -96,6 +96,15 @@ func headerize(g GuardFunc) GuardFunc {
 			if cr.Timeout > 0 {
 				fmt.Fprintf(w, "// timeout: %s\n", cr.Timeout)
 			}
+			if cr.IdleTimeout > 0 {
+				fmt.Fprintf(w, "// idle-timeout: %s (%s)\n", cr.IdleTimeout, cr.IdleAction)
+			}
+			if cr.LockWait > 0 {
+				fmt.Fprintf(w, "// lock-wait: %s\n", cr.LockWait)
+			}
+			if cr.Semaphore != nil {
+				fmt.Fprintf(w, "// semaphore: %s\n", cr.Semaphore)
+			}
 		}
 
 		err = g(ctx, cr)
@@ -105,8 +114,17 @@ func headerize(g GuardFunc) GuardFunc {
 		if !cr.ErrFileQuiet {
 			fmt.Fprintf(w, "// end: %s\n", end.Format(time.RFC3339))
 			fmt.Fprintf(w, "// took: %s\n", end.Sub(start))
+			if cr.Status.LockWaited > 0 {
+				fmt.Fprintf(w, "// waited for lock: %s\n", cr.Status.LockWaited)
+			}
+			if cr.Status.SemaphoreWaited > 0 {
+				fmt.Fprintf(w, "// waited for semaphore: %s\n", cr.Status.SemaphoreWaited)
+			}
 			fmt.Fprintf(w, "// exitcode: %d\n", cr.Status.ExitCode)
 		}
+		if cr.Status.Killed != "" {
+			fmt.Fprintf(w, "// killed: %s\n", cr.Status.Killed)
+		}
 		if err != nil {
 			fmt.Fprintf(w, "// error: %s\n", err.Error())
 		}
@@ -114,92 +132,215 @@ func headerize(g GuardFunc) GuardFunc {
 	}
 }
 
-// lockfile ensures that the cron will only run once if logfile flag is set
+// lockfile ensures that the cron will only run once if lockfile flag is set
 func lockfile(g GuardFunc) GuardFunc {
 	return func(ctx context.Context, cr *CmdRequest) (err error) {
-		if cr.Lockfile != "" {
-			run, err := handleExistingLockfile(cr)
+		if cr.Lockfile == "" {
+			return g(ctx, cr)
+		}
+		locker, err := newLocker(cr)
+		if err != nil {
+			return err
+		}
+		lock, holder, err := locker.Acquire(ctx, newLockInfo(cr))
+		if err != nil {
+			return err
+		}
+		if lock == nil && cr.LockWait > 0 {
+			start := time.Now()
+			lock, err = waitLock(ctx, locker, newLockInfo(cr), cr.LockWait)
+			cr.Status.LockWaited = time.Since(start)
 			if err != nil {
 				return err
 			}
-			if !run {
-				return nil
+		}
+		if lock == nil {
+			if host := holder.remoteHost(); host != "" {
+				cr.Status.Skipped = fmt.Sprintf("skipped, held by host %s, pid: %s", host, holder.pid())
+			} else {
+				cr.Status.Skipped = fmt.Sprintf("cron is still running, pid: %s", holder.pid())
+			}
+			_, _ = fmt.Fprintln(cr.Status.Combined, cr.Status.Skipped)
+			if cr.LockAlertSkips > 0 || cr.LockAlertAge > 0 {
+				stuck, err := checkStuckLock(cr, holder, time.Now())
+				if err != nil {
+					log.Warn().Err(err).Msg("unable to track skipped runs")
+				}
+				if stuck != nil && cr.Reporter != nil {
+					_ = cr.Reporter.Warn(stuck)
+				}
+			}
+			return nil
+		}
+		if cr.LockAlertSkips > 0 || cr.LockAlertAge > 0 {
+			if err := resetSkippedRuns(cr); err != nil {
+				log.Warn().Err(err).Msg("unable to track skipped runs")
 			}
+		}
 
-			pid := os.Getpid()
-			lockfile, err := os.OpenFile(cr.Lockfile, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
-			if err != nil {
-				return fmt.Errorf("unable to open lockfile: %s", err)
+		// if the previous run crashed, we try to report that to our reporter and continue
+		if stale := lock.Stale(); stale != nil && cr.Reporter != nil {
+			cr.Reporter.Info(fmt.Errorf("lockfile of previous run was not released, pid: %s", stale.pid()))
+		}
+
+		// stop the cron if another run took over a shared lock
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		lost := false
+		done := make(chan struct{})
+		watcher := errgroup.Group{}
+		watcher.Go(func() error {
+			select {
+			case <-lock.Lost():
+				lost = true
+				cancel()
+			case <-done:
 			}
-			defer lockfile.Close()
-			_, err = fmt.Fprintf(lockfile, "%d", pid)
+			return nil
+		})
+
+		err = g(ctx, cr)
+		log.Debug().Err(err).Str("middleware", "lockfile").Msg("executed")
+
+		close(done)
+		_ = watcher.Wait()
+		releaseErr := lock.Release()
+		if lost {
+			cr.Status.Killed = errLockLost.Error()
+			return errLockLost
+		}
+		if releaseErr != nil {
+			log.Warn().Err(releaseErr).Msg("unable to release lock")
+			if err == nil {
+				return fmt.Errorf("unable to release lock: %s", releaseErr)
+			}
+		}
+		return err
+	}
+}
+
+// semaphoreSlot limits the number of concurrent crons if the semaphore flag is set
+func semaphoreSlot(g GuardFunc) GuardFunc {
+	return func(ctx context.Context, cr *CmdRequest) (err error) {
+		if cr.Semaphore != nil {
+			lock, err := cr.Semaphore.acquire(cr.Config, newLockInfo(cr))
 			if err != nil {
-				return fmt.Errorf("unable to write lockfile: %s", err)
+				return err
 			}
-			defer os.Remove(cr.Lockfile)
+			if lock == nil && cr.SemaphoreWait > 0 {
+				start := time.Now()
+				lock, err = cr.Semaphore.wait(ctx, cr.Config, newLockInfo(cr), cr.SemaphoreWait)
+				cr.Status.SemaphoreWaited = time.Since(start)
+				if err != nil {
+					return err
+				}
+			}
+			if lock == nil {
+				cr.Status.Skipped = fmt.Sprintf("skipped, all %d slots of semaphore %s are taken", cr.Semaphore.Slots, cr.Semaphore.Name)
+				_, _ = fmt.Fprintln(cr.Status.Combined, cr.Status.Skipped)
+				return nil
+			}
+			defer lock.Release()
 		}
 
 		err = g(ctx, cr)
-		log.Debug().Err(err).Str("middleware", "lockfile").Msg("executed")
+		log.Debug().Err(err).Str("middleware", "semaphoreSlot").Msg("executed")
 
 		return err
 	}
 }
 
-// sentryHandler redirects all errors to a sentry if configured
-func sentryHandler(g GuardFunc) GuardFunc {
+// notifyHandler reports all errors to the configured notifiers
+func notifyHandler(g GuardFunc) GuardFunc {
 	return func(ctx context.Context, cr *CmdRequest) (err error) {
 		reporter, reporterErr := newReporter(cr)
 		if reporterErr != nil {
-			log.Debug().Err(reporterErr).Msg("sentry is disabled")
+			log.Debug().Err(reporterErr).Msg("notifications are disabled")
 			return g(ctx, cr)
 		}
 
 		cr.Reporter = reporter
+		reporter.Start()
 
 		err = g(ctx, cr)
-		log.Debug().Err(err).Str("middleware", "sentryHandler").Msg("executed")
+		log.Debug().Err(err).Str("middleware", "notifyHandler").Msg("executed")
 
 		return reporter.Finish(err)
 	}
 }
 
-// quietIgnore allows to ignore errors on lower settings if flag is set
+// quietIgnore ignores, downgrades or skips the cron during quiet windows and silences if flag is set
 func quietIgnore(g GuardFunc) GuardFunc {
 	return func(ctx context.Context, cr *CmdRequest) (err error) {
-		quiet, err := isQuiet(cr)
+		now := time.Now()
+		reason, mode := "", ""
+		window, err := activeQuietWindow(cr, now)
 		if err != nil {
 			log.Fatal().Err(err).Msg("quiet-time malformed")
 		}
+		if window != nil {
+			reason, mode = fmt.Sprintf("quiet window %s", window.Name), window.Mode
+		}
+		silence, err := activeSilence(cr, now)
+		if err != nil {
+			log.Error().Err(err).Msg("unable to load silences")
+		}
+		if silence != nil && reason == "" {
+			reason, mode = silence.String(), silence.Mode
+			// record who silenced the run and why, the combined log is also sent to syslog
+			_, _ = fmt.Fprintf(cr.Status.Combined, "// silenced: %s\n", reason)
+			log.Info().Str("silence", silence.ID).Str("by", silence.CreatedBy).Str("reason", silence.Reason).Msg("silenced")
+		}
+		if mode == quietSkip {
+			log.Info().Str("reason", reason).Msg("skipped")
+			return &QuietError{Reason: reason, Mode: mode}
+		}
 
 		err = g(ctx, cr)
 		log.Debug().Err(err).Str("middleware", "quietIgnore").Msg("executed")
 
-		if quiet {
-			return nil
+		if reason == "" || err == nil {
+			return err
 		}
-		return err
+		if mode == quietDowngrade {
+			return &QuietError{Reason: reason, Mode: mode, Err: err}
+		}
+		// the failure is hidden, but must not count as success
+		cr.Status.Silenced = reason
+		return nil
 	}
-
 }
 
 // validateStderr requires stderr to be empty
 func validateStderr(g GuardFunc) GuardFunc {
 	return func(ctx context.Context, cr *CmdRequest) (err error) {
 		stderr := cr.Status.Stderr
-		wc := NewWriteCounter(stderr)
-		cr.Status.Stderr = wc
+		out, in := io.Pipe()
+		cr.Status.Stderr = io.MultiWriter(stderr, in)
+
+		errGrp := errgroup.Group{}
+		errGrp.Go(func() error {
+			var err error
+			scanErr := scanLines(out, func(line []byte) {
+				if bad := checkStderrLine(cr, line); bad != nil && err == nil {
+					err = bad
+				}
+			})
+			if scanErr != nil {
+				return scanErr
+			}
+			return err
+		})
 
 		err = g(ctx, cr)
 		log.Debug().Err(err).Str("middleware", "validateStderr").Msg("executed")
 
+		_ = in.Close()
+		validateErr := errGrp.Wait()
 		if err != nil {
 			return err
 		}
-		if wc.GetCounter() > 0 {
-			return errors.New("stderr is not empty")
-		}
-		return err
+		return validateErr
 	}
 }
 
@@ -210,21 +351,27 @@ func validateStdout(g GuardFunc) GuardFunc {
 		out, in := io.Pipe()
 		cr.Status.Stdout = io.MultiWriter(stdout, in)
 
-		s := bufio.NewScanner(out)
 		errGrp := errgroup.Group{}
 		errGrp.Go(func() error {
-			var err error
-			for s.Scan() {
-				line := s.Bytes()
-				if readErr := s.Err(); readErr != nil {
-					return readErr
-				}
-				match := cr.Regex.Match(line)
-				if match {
-					err = fmt.Errorf("bad keyword in command output: %s", line)
+			var first, last *OutputError
+			scanErr := scanLines(out, func(line []byte) {
+				if bad := checkStdoutLine(cr, line); bad != nil {
+					if first == nil {
+						first = bad
+					}
+					last = bad
 				}
+			})
+			if scanErr != nil {
+				return scanErr
 			}
-			return err
+			if last == nil {
+				return nil
+			}
+			if first != last {
+				last.First = first.Line
+			}
+			return last
 		})
 
 		err = g(ctx, cr)
@@ -242,12 +389,36 @@ func validateStdout(g GuardFunc) GuardFunc {
 	}
 }
 
+// validateExitCode applies the exit code meanings of the rule packs if flag is set
+func validateExitCode(g GuardFunc) GuardFunc {
+	return func(ctx context.Context, cr *CmdRequest) (err error) {
+		err = g(ctx, cr)
+		log.Debug().Err(err).Str("middleware", "validateExitCode").Msg("executed")
+
+		if err == nil || cr.Status.ExitCode == 0 {
+			return err
+		}
+		exitCode, ok := cr.Rules.exitCode(cr.Status.ExitCode)
+		if !ok {
+			return err
+		}
+		if exitCode.OK {
+			log.Info().Int("exitcode", cr.Status.ExitCode).Str("meaning", exitCode.Meaning).Msg("exit code accepted by rules")
+			return nil
+		}
+		return fmt.Errorf("%w (%s)", err, exitCode.Meaning)
+	}
+}
+
 // timeout adds a timeout for the command if flag is set
 func timeout(g GuardFunc) GuardFunc {
 	return func(ctx context.Context, cr *CmdRequest) (err error) {
-		ctx, cancel := context.WithCancel(ctx)
+		// derived from ctx, the outer middlewares may stop the command as well
+		var cancel context.CancelFunc
 		if cr.Timeout > time.Duration(0) {
-			ctx, cancel = context.WithTimeout(context.Background(), cr.Timeout)
+			ctx, cancel = context.WithTimeout(ctx, cr.Timeout)
+		} else {
+			ctx, cancel = context.WithCancel(ctx)
 		}
 		defer cancel()
 
@@ -262,3 +433,80 @@ func timeout(g GuardFunc) GuardFunc {
 		return err
 	}
 }
+
+const (
+	// idleKill kills the command on idle-timeout
+	idleKill = "kill"
+	// idleWarn only reports the command on idle-timeout
+	idleWarn = "warn"
+)
+
+// idleTimeout kills the command or warns if there is no output for too long if flag is set
+func idleTimeout(g GuardFunc) GuardFunc {
+	return func(ctx context.Context, cr *CmdRequest) (err error) {
+		if cr.IdleTimeout <= time.Duration(0) {
+			return g(ctx, cr)
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		activity := NewActivityTracker()
+		cr.Status.Stdout = activity.Wrap(cr.Status.Stdout)
+		cr.Status.Stderr = activity.Wrap(cr.Status.Stderr)
+
+		idleErr := fmt.Errorf("no output for %s", shortDuration(cr.IdleTimeout))
+		killed := false
+		done := make(chan struct{})
+		watcher := errgroup.Group{}
+		watcher.Go(func() error {
+			warned := time.Time{}
+			for {
+				last := activity.Last()
+				wait := time.Until(last.Add(cr.IdleTimeout))
+				if wait <= 0 && last != warned {
+					if cr.IdleAction == idleKill {
+						killed = true
+						cancel()
+						return nil
+					}
+					log.Warn().Err(idleErr).Str("middleware", "idleTimeout").Msg("command is idle")
+					if cr.Reporter != nil {
+						_ = cr.Reporter.Warn(idleErr)
+					}
+					warned = last
+				}
+				if wait <= 0 {
+					wait = cr.IdleTimeout
+				}
+				select {
+				case <-done:
+					return nil
+				case <-time.After(wait):
+				}
+			}
+		})
+
+		err = g(ctx, cr)
+		log.Debug().Err(err).Str("middleware", "idleTimeout").Msg("executed")
+
+		close(done)
+		_ = watcher.Wait()
+		if killed {
+			cr.Status.Killed = idleErr.Error()
+			return idleErr
+		}
+		return err
+	}
+}
+
+// shortDuration formats d without trailing zero units, 15m instead of 15m0s
+func shortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
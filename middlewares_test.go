@@ -3,7 +3,7 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -23,6 +23,16 @@ type Suite struct{}
 
 var _ = check.Suite(&Suite{})
 
+// SetUpTest keeps the state of every test, like spooled reports, in a temporary directory
+func (s *Suite) SetUpTest(c *check.C) {
+	os.Setenv("CRONGUARD_STATE_DIR", c.MkDir())
+}
+
+// TearDownTest resets the state directory
+func (s *Suite) TearDownTest(c *check.C) {
+	os.Unsetenv("CRONGUARD_STATE_DIR")
+}
+
 func (s *Suite) TestSetupLogs(c *check.C) {
 	mockCases := newMockCases()
 	// setupLogs consumes stdout
@@ -69,18 +79,17 @@ func (s *Suite) TestHeaderize(c *check.C) {
 	mockCases[4].validate(c, headerize, mockCombinedCheck(&check.Matches), mockCombined("(?s).*error: problems\n$"))
 }
 
-func (s *Suite) TestSentryHandler(c *check.C) {
+func (s *Suite) TestNotifyHandler(c *check.C) {
 	// disabled
 	mockCases := newMockCases()
 	for _, cse := range mockCases {
-		cse.validate(c, sentryHandler)
+		cse.validate(c, notifyHandler)
 	}
 
 	// http testserver
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/1/store/", func(w http.ResponseWriter, r *http.Request) {
-		var payload map[string]interface{}
-		json.NewDecoder(r.Body).Decode(&payload)
+	mux.HandleFunc("/api/1/envelope/", func(w http.ResponseWriter, r *http.Request) {
+		payload, attachments := readEnvelopeEvent(c, r.Body)
 		message, ok := payload["message"].(string)
 		c.Assert(ok, check.Equals, true)
 		c.Assert(message, check.Matches, `.*: echo running go tests \(problems\)`)
@@ -89,11 +98,22 @@ func (s *Suite) TestSentryHandler(c *check.C) {
 		command, ok := extra["command"].(string)
 		c.Assert(ok, check.Equals, true)
 		c.Assert(command, check.Equals, "echo running go tests")
-		out_combined, ok := extra["out_combined"].(string)
+		out_tail, ok := extra["out_tail"].(string)
 		c.Assert(ok, check.Equals, true)
-		c.Assert(out_combined, check.Equals, "hi")
+		c.Assert(out_tail, check.Equals, "hi")
+		c.Assert(attachments["combined.log.gz"], check.Equals, "hi")
 	})
-	mux.HandleFunc("/api/3/store/", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/api/4/envelope/", func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := readEnvelopeEvent(c, r.Body)
+		fingerprint, ok := payload["fingerprint"].([]interface{})
+		c.Assert(ok, check.Equals, true)
+		c.Assert(fingerprint, check.DeepEquals, []interface{}{"{{ default }}"})
+		exception, ok := payload["exception"].([]interface{})
+		c.Assert(ok, check.Equals, true)
+		c.Assert(exception, check.HasLen, 1)
+		c.Assert(exception[0].(map[string]interface{})["type"], check.Equals, "KeyError")
+	})
+	mux.HandleFunc("/api/3/envelope/", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(os.Stdout, "called")
 		<-time.After(35 * time.Second)
 	})
@@ -103,26 +123,45 @@ func (s *Suite) TestSentryHandler(c *check.C) {
 	os.Setenv("CRONGUARD_SENTRY_DSN", fmt.Sprintf("http://testuser@%s/1", server.Listener.Addr().String()))
 	mockCases = newMockCases()
 	for _, cse := range mockCases[0:3] {
-		cse.validate(c, sentryHandler)
+		cse.validate(c, notifyHandler)
 	}
-	mockCases[4].validate(c, sentryHandler, mockNoError{})
+	mockCases[4].validate(c, notifyHandler, mockNoError{})
+	downgraded := &QuietError{Reason: "quiet window test", Mode: quietDowngrade, Err: fmt.Errorf("problems")}
+	mockCase{
+		name:            "downgraded",
+		f:               mockRunner("hi", "", 0, downgraded),
+		defaultStdout:   "hi",
+		defaultCombined: "hi",
+		defaultError:    downgraded,
+	}.validate(c, notifyHandler)
+
+	// enabled with traceback
+	os.Setenv("CRONGUARD_SENTRY_DSN", fmt.Sprintf("http://testuser@%s/4", server.Listener.Addr().String()))
+	traceback := "Traceback (most recent call last):\n  File \"job.py\", line 1, in <module>\nKeyError: 'id'\n"
+	mockCase{
+		name:            "traceback",
+		f:               mockRunner("", traceback, 1, fmt.Errorf("exit status 1")),
+		defaultStderr:   traceback,
+		defaultCombined: traceback,
+		defaultExitcode: 1,
+	}.validate(c, notifyHandler)
 
 	// enabled broken
 	os.Setenv("CRONGUARD_SENTRY_DSN", fmt.Sprintf("http://%s/2", server.Listener.Addr().String()))
 	mockCases = newMockCases()
 	for _, cse := range mockCases {
-		cse.validate(c, sentryHandler, mockStderrCheck(&check.Matches), mockStderr("(?s).*empty username.*"))
+		cse.validate(c, notifyHandler, mockStderrCheck(&check.Matches), mockStderr("(?s).*empty username.*"))
 	}
 
 	// timeout
 	os.Setenv("CRONGUARD_SENTRY_DSN", fmt.Sprintf("http://testuser@%s/3", server.Listener.Addr().String()))
 	SentryTimeout = 2 * time.Second
 	mockCases = newMockCases()
-	mockCases[0].validate(c, sentryHandler)
-	mockCases[1].validate(c, sentryHandler)
-	mockCases[2].validate(c, sentryHandler)
-	mockCases[3].validate(c, sentryHandler)
-	mockCases[4].validate(c, sentryHandler)
+	mockCases[0].validate(c, notifyHandler)
+	mockCases[1].validate(c, notifyHandler)
+	mockCases[2].validate(c, notifyHandler)
+	mockCases[3].validate(c, notifyHandler)
+	mockCases[4].validate(c, notifyHandler)
 }
 
 func (s *Suite) TestQuietIgnore(c *check.C) {
@@ -130,13 +169,28 @@ func (s *Suite) TestQuietIgnore(c *check.C) {
 	for _, cse := range mockCases {
 		cse.validate(c, quietIgnore)
 	}
+
+	// a silenced failure is recorded for the reporter
+	cr := &CmdRequest{QuietTimes: "* * * * *:1h", QuietMode: quietSilence}
+	cr.Status = &CmdStatus{Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}, Combined: &bytes.Buffer{}}
+	err := quietIgnore(mockRunner("", "", 1, fmt.Errorf("exit status 1")))(context.Background(), cr)
+	c.Assert(err, check.IsNil)
+	c.Assert(cr.Status.Silenced, check.Equals, "quiet window * * * * *:1h")
+}
+
+func (s *Suite) TestQuietError(c *check.C) {
+	err := error(&QuietError{Reason: "quiet window db-backup", Mode: quietDowngrade, Err: fmt.Errorf("exit status 1")})
+	c.Assert(err, check.ErrorMatches, `exit status 1 \(quiet window db-backup\)`)
+	c.Assert(errors.Unwrap(err), check.ErrorMatches, "exit status 1")
+	err = &QuietError{Reason: "quiet window db-backup", Mode: quietSkip}
+	c.Assert(err, check.ErrorMatches, "skipped during quiet window db-backup")
 }
 
 func (s *Suite) TestValidateStderr(c *check.C) {
 	mockCases := newMockCases()
 	mockCases[0].validate(c, validateStderr)
 	mockCases[1].validate(c, validateStderr)
-	mockCases[2].validate(c, validateStderr, mockError(fmt.Errorf("stderr is not empty")))
+	mockCases[2].validate(c, validateStderr, mockError(&OutputError{Stream: "stderr", Line: "oops", Rule: "stderr"}))
 	mockCases[3].validate(c, validateStderr)
 	mockCases[4].validate(c, validateStderr)
 }
@@ -144,17 +198,70 @@ func (s *Suite) TestValidateStderr(c *check.C) {
 func (s *Suite) TestValidateStdout(c *check.C) {
 	mockCases := newMockCases()
 	mockCases[0].validate(c, validateStdout)
-	mockCases[1].validate(c, validateStdout, mockError(fmt.Errorf("bad keyword in command output: ERR: something went wrong")))
+	mockCases[1].validate(c, validateStdout, mockError(&OutputError{Stream: "stdout", Line: "ERR: something went wrong", Rule: "regex"}))
 	mockCases[2].validate(c, validateStdout)
 	mockCases[3].validate(c, validateStdout)
 	mockCases[4].validate(c, validateStdout)
 }
 
+func (s *Suite) TestIdleTimeout(c *check.C) {
+	mockCases := newMockCases()
+	for _, cse := range mockCases {
+		cse.validate(c, idleTimeout)
+	}
+
+	// the sleeping child keeps the output open, the whole process group is killed
+	stdout := &bytes.Buffer{}
+	cr := &CmdRequest{Command: "echo started; sleep 5; echo done", IdleTimeout: 300 * time.Millisecond, IdleAction: idleKill}
+	cr.Status = &CmdStatus{Stdout: stdout, Stderr: &bytes.Buffer{}}
+	start := time.Now()
+	err := idleTimeout(runner())(context.Background(), cr)
+	c.Assert(time.Since(start) < 2*time.Second, check.Equals, true)
+	c.Assert(err, check.ErrorMatches, "no output for 300ms")
+	c.Assert(cr.Status.Killed, check.Equals, "no output for 300ms")
+	c.Assert(cr.Status.ExitCode, check.Equals, -1)
+	c.Assert(stdout.String(), check.Equals, "started\n")
+}
+
+func (s *Suite) TestIdleTimeoutWarn(c *check.C) {
+	notifier := &mockNotifier{}
+	reporter := newMockReporter(namedNotifier{Notifier: notifier, name: "mock", timeout: time.Second})
+	reporter.combined.Reset()
+	cr := &CmdRequest{Command: "echo started; sleep 1; echo done", IdleTimeout: 300 * time.Millisecond, IdleAction: idleWarn}
+	cr.Status = &CmdStatus{Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}}
+	cr.Reporter = reporter
+	reporter.capture(cr.Status)
+	err := idleTimeout(runner())(context.Background(), cr)
+	c.Assert(err, check.IsNil)
+	c.Assert(cr.Status.Killed, check.Equals, "")
+	c.Assert(notifier.results, check.HasLen, 1)
+	c.Assert(notifier.results[0].Severity, check.Equals, warnLevel)
+	c.Assert(notifier.results[0].Err, check.ErrorMatches, "no output for 300ms")
+	c.Assert(notifier.results[0].Output, check.Equals, "started\n")
+	c.Assert(reporter.combined.String(), check.Equals, "started\ndone\n")
+}
+
+func (s *Suite) TestShortDuration(c *check.C) {
+	c.Assert(shortDuration(15*time.Minute), check.Equals, "15m")
+	c.Assert(shortDuration(2*time.Hour), check.Equals, "2h")
+	c.Assert(shortDuration(90*time.Minute), check.Equals, "1h30m")
+	c.Assert(shortDuration(10*time.Second), check.Equals, "10s")
+	c.Assert(shortDuration(500*time.Millisecond), check.Equals, "500ms")
+}
+
 func (s *Suite) TestTimeout(c *check.C) {
 	mockCases := newMockCases()
 	for _, cse := range mockCases {
 		cse.validate(c, timeout)
 	}
+
+	// without idle-timeout the command stays in our process group and is killed by the context
+	cr := &CmdRequest{Command: "sleep 5", Timeout: 300 * time.Millisecond}
+	cr.Status = &CmdStatus{Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}}
+	start := time.Now()
+	err := timeout(runner())(context.Background(), cr)
+	c.Assert(time.Since(start) < 2*time.Second, check.Equals, true)
+	c.Assert(err, check.Equals, context.DeadlineExceeded)
 }
 
 type (
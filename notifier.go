@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type (
+	// Notifier delivers the result of a run to a notification backend
+	Notifier interface {
+		// Notify sends the result, ref identifies the notification (like an
+		// event id) and is given back in the Recovery of the run that recovers
+		Notify(ctx context.Context, result *RunResult) (ref string, err error)
+	}
+
+	// runObserver is implemented by notifiers that track every run, not only
+	// failed ones, like sentry check-ins
+	runObserver interface {
+		Started(ctx context.Context, result *RunResult)
+		Finished(ctx context.Context, result *RunResult)
+	}
+
+	// RunResult is the structured outcome of a run that is given to the notifiers
+	RunResult struct {
+		Name     string
+		Command  string
+		Host     string
+		UUID     string
+		Start    time.Time
+		End      time.Time
+		ExitCode int
+		Err      error
+		Severity reportLevel
+		Skipped  string // reason if the run was skipped by the lock or semaphore
+
+		// captured output of the run
+		Output string
+		Stdout string
+		Stderr string
+
+		LockWaited      time.Duration
+		SemaphoreWaited time.Duration
+		Recovery        *Recovery // set if Severity is recoveredLevel
+	}
+
+	// resultData is the run result in the templates of the notifiers
+	resultData struct {
+		Name     string    `json:"name"`
+		Command  string    `json:"command"`
+		Host     string    `json:"host"`
+		UUID     string    `json:"uuid,omitempty"`
+		Start    time.Time `json:"start"`
+		End      time.Time `json:"end"`
+		Duration string    `json:"duration"`
+		ExitCode int       `json:"exit_code"`
+		Error    string    `json:"error,omitempty"`
+		Severity string    `json:"severity"`
+		Tail     string    `json:"output_tail"`
+		Output   string    `json:"-"`
+	}
+
+	// namedNotifier is a configured notifier
+	namedNotifier struct {
+		Notifier
+		name    string
+		timeout time.Duration
+	}
+
+	// Reporter fans out the results of a run to all configured notifiers
+	Reporter struct {
+		notifiers []namedNotifier
+		start     time.Time
+		name      string
+		stateName string
+		command   string
+		hostname  string
+		config    *Config
+
+		combined *bytes.Buffer
+		stdout   *bytes.Buffer
+		stderr   *bytes.Buffer
+		output   sync.Mutex // guards the buffers, warnings are sent while the cron writes
+		status   *CmdStatus
+
+		started chan struct{} // closed once the observers know the cron started
+	}
+)
+
+// sentryNotifierName is the name of the built-in sentry notifier
+const sentryNotifierName = "sentry"
+
+// newReporter creates the configured notifiers of the cron
+func newReporter(cr *CmdRequest) (*Reporter, error) {
+	notifiers := []namedNotifier{}
+	selected := cr.Config.job(cr.Name).Notifiers
+	enabled := func(name string) bool {
+		if selected == nil {
+			return true
+		}
+		for _, s := range selected {
+			if s == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	if enabled(sentryNotifierName) {
+		sentry, err := newSentryNotifier(cr)
+		if err != nil {
+			log.Debug().Err(err).Msg("sentry is disabled")
+		} else {
+			notifiers = append(notifiers, namedNotifier{
+				Notifier: sentry,
+				name:     sentryNotifierName,
+				timeout:  cr.Config.sentryConfig().timeout(cr.Config.httpConfig()),
+			})
+		}
+	}
+
+	names := []string{}
+	for name := range cr.Config.notifiers() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !enabled(name) {
+			continue
+		}
+		config := cr.Config.notifiers()[name]
+		notifier, err := newNotifier(cr, name, config)
+		if errors.Is(err, errNoRecipients) {
+			// no delivery is claimed for it, without other notifiers the errfile is written
+			log.Debug().Str("notifier", name).Msg("mails are disabled")
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(cr.Status.Stderr, "cronguard: unable to setup notifier %s: %s\n", name, err)
+			continue
+		}
+		notifiers = append(notifiers, namedNotifier{
+			Notifier: notifier,
+			name:     name,
+			timeout:  config.timeout(cr.Config.httpConfig()),
+		})
+	}
+	if len(notifiers) == 0 {
+		return nil, errors.New("no notifiers configured")
+	}
+
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "no-hostname"
+	}
+	r := &Reporter{
+		notifiers: notifiers,
+		start:     time.Now(),
+		name:      cr.Name,
+		stateName: cr.stateName(),
+		command:   cr.Command,
+		hostname:  strings.SplitN(hostname, ".", 2)[0],
+		config:    cr.Config,
+		combined:  bytes.NewBuffer([]byte{}),
+		stdout:    bytes.NewBuffer([]byte{}),
+		stderr:    bytes.NewBuffer([]byte{}),
+	}
+	r.capture(cr.Status)
+	return r, nil
+}
+
+// capture wraps the outputs of the status to keep a copy for the reports
+func (r *Reporter) capture(status *CmdStatus) {
+	status.Stderr = io.MultiWriter(NewSharedLockedWriter(io.MultiWriter(r.stderr, r.combined), &r.output), status.Stderr)
+	status.Stdout = io.MultiWriter(NewSharedLockedWriter(io.MultiWriter(r.stdout, r.combined), &r.output), status.Stdout)
+	r.status = status
+}
+
+// newNotifier creates the notifier of a notifiers entry in the config
+func newNotifier(cr *CmdRequest, name string, config NotifierConfig) (Notifier, error) {
+	switch {
+	case config.Webhook != nil:
+		return newWebhookNotifier(cr.Config.httpConfig(), *config.Webhook)
+	case config.SMTP != nil:
+		return newMailNotifier(cr.Config.httpConfig(), *config.SMTP, cr.Config.job(cr.Name).MailTo)
+	case config.Slack != nil:
+		return newSlackNotifier(cr.Config.httpConfig(), name, *config.Slack, cr.Config.job(cr.Name).Slack)
+	default:
+		return nil, fmt.Errorf("no backend configured")
+	}
+}
+
+// Start tells the notifiers that track every run that the cron has started, in
+// the background to not delay the cron
+func (r *Reporter) Start() {
+	result := r.result(nil, infoLevel)
+	r.started = make(chan struct{})
+	go func() {
+		defer close(r.started)
+		r.observe(func(ctx context.Context, observer runObserver) {
+			observer.Started(ctx, result)
+		})
+	}()
+}
+
+// Finish reports the final status if err != nil, or the recovery if the cron
+// succeeded after failed runs. the error is hidden if all notifiers delivered it
+func (r *Reporter) Finish(err error) error {
+	result := r.result(err, finishLevel)
+	if r.started != nil {
+		// the final check-in must not overtake the start
+		<-r.started
+	}
+	r.observe(func(ctx context.Context, observer runObserver) {
+		observer.Finished(ctx, result)
+	})
+	if err == nil {
+		r.trackOutcome(nil, nil)
+		return nil
+	}
+	quietErr := &QuietError{}
+	if errors.As(err, &quietErr) {
+		// keep the error for the errfile, skipped runs are not reported
+		if quietErr.Mode == quietDowngrade {
+			_, _ = r.notify(r.result(quietErr.Err, downgradeLevel))
+		}
+		return err
+	}
+	refs, notifyErr := r.notify(result)
+	r.trackOutcome(err, refs)
+	if notifyErr != nil {
+		return err
+	}
+	return nil
+}
+
+// Info reports an information while the cron is running
+func (r *Reporter) Info(err error) error {
+	_, notifyErr := r.notify(r.result(err, infoLevel))
+	return notifyErr
+}
+
+// Warn reports a warning while the cron is running
+func (r *Reporter) Warn(err error) error {
+	_, notifyErr := r.notify(r.result(err, warnLevel))
+	return notifyErr
+}
+
+// trackOutcome keeps the outcome in the job state and reports recoveries. runs
+// skipped by the lock or semaphore did not run and silenced failures did not
+// succeed, both are ignored like quiet runs
+func (r *Reporter) trackOutcome(err error, refs map[string]string) {
+	if r.status != nil && (r.status.Skipped != "" || r.status.Silenced != "") {
+		return
+	}
+	recovery, stateErr := trackOutcome(r.config, r.stateName, err, r.start, refs)
+	if stateErr != nil {
+		log.Warn().Err(stateErr).Msg("unable to track outcome")
+	}
+	if recovery == nil {
+		return
+	}
+	result := r.result(recovery, recoveredLevel)
+	result.Recovery = recovery
+	_, _ = r.notify(result)
+}
+
+// reportLevel is the severity of a run result
+type reportLevel = string
+
+const (
+	// infoLevel is an information while the cron is running
+	infoLevel reportLevel = "info"
+	// warnLevel is a warning while the cron is running
+	warnLevel = "warning"
+	// finishLevel is used if the cron has finished with an error
+	finishLevel = "finish"
+	// downgradeLevel is used if the cron has finished with an error during a quiet window
+	downgradeLevel = "downgrade"
+	// recoveredLevel is used if the cron has finished successfully after failed runs
+	recoveredLevel = "recovered"
+)
+
+// severities are the stable names of the levels in payloads and the config, downgraded
+// failures are info like in sentry
+var severities = map[reportLevel]string{
+	finishLevel:    "error",
+	downgradeLevel: "info",
+	warnLevel:      "warning",
+	infoLevel:      "info",
+	recoveredLevel: "recovered",
+}
+
+// severity returns the public name of a level
+func severity(level reportLevel) string {
+	if name, ok := severities[level]; ok {
+		return name
+	}
+	return level
+}
+
+// result returns the current state of the run
+func (r *Reporter) result(err error, level reportLevel) *RunResult {
+	r.output.Lock()
+	result := &RunResult{
+		Name:     r.name,
+		Command:  r.command,
+		Host:     r.hostname,
+		Start:    r.start,
+		End:      time.Now(),
+		Err:      err,
+		Severity: level,
+		Output:   r.combined.String(),
+		Stdout:   r.stdout.String(),
+		Stderr:   r.stderr.String(),
+	}
+	r.output.Unlock()
+	if r.status != nil {
+		result.ExitCode = r.status.ExitCode
+		result.UUID = r.status.UUID
+		result.Skipped = r.status.Skipped
+		result.LockWaited = r.status.LockWaited
+		result.SemaphoreWaited = r.status.SemaphoreWaited
+	}
+	return result
+}
+
+// notify sends the result to all notifiers in parallel, an error is returned
+// if any notifier failed. refs contains the references of the notifications
+func (r *Reporter) notify(result *RunResult) (map[string]string, error) {
+	refs := map[string]string{}
+	failed := []string{}
+	mutex := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for _, n := range r.notifiers {
+		wg.Add(1)
+		go func(n namedNotifier) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), n.timeout)
+			defer cancel()
+			ref, err := n.Notify(ctx, result)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				log.Warn().Err(err).Str("notifier", n.name).Msg("notification failed")
+				failed = append(failed, n.name)
+				return
+			}
+			if ref != "" {
+				refs[n.name] = ref
+			}
+		}(n)
+	}
+	wg.Wait()
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return refs, fmt.Errorf("notifiers failed: %s", strings.Join(failed, ", "))
+	}
+	return refs, nil
+}
+
+// observe calls f for all notifiers that track every run in parallel
+func (r *Reporter) observe(f func(ctx context.Context, observer runObserver)) {
+	wg := &sync.WaitGroup{}
+	for _, n := range r.notifiers {
+		observer, ok := n.Notifier.(runObserver)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(n namedNotifier) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), n.timeout)
+			defer cancel()
+			f(ctx, observer)
+		}(n)
+	}
+	wg.Wait()
+}
+
+// Duration returns the runtime of the cron
+func (r *RunResult) Duration() time.Duration {
+	return r.End.Sub(r.Start)
+}
+
+// Tail returns the last n lines of the output
+func (r *RunResult) Tail(n int) string {
+	return tailLines(r.Output, n)
+}
+
+// data returns the template data of the result, tail contains the last lines of the output
+func (r *RunResult) data(lines int) resultData {
+	data := resultData{
+		Name:     r.Name,
+		Command:  r.Command,
+		Host:     r.Host,
+		UUID:     r.UUID,
+		Start:    r.Start,
+		End:      r.End,
+		Duration: r.Duration().Round(time.Millisecond).String(),
+		ExitCode: r.ExitCode,
+		Severity: severity(r.Severity),
+		Tail:     r.Tail(lines),
+		Output:   r.Output,
+	}
+	if r.Err != nil {
+		data.Error = r.Err.Error()
+	}
+	return data
+}
+
+// templateFuncs are available in the templates of the notifiers
+var templateFuncs = template.FuncMap{
+	// json quotes a value for json payloads
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	// tail returns the last n lines of s
+	"tail": func(n int, s string) string {
+		return tailLines(s, n)
+	},
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+// mockNotifier records the results it is given
+type mockNotifier struct {
+	mutex   sync.Mutex
+	delay   time.Duration
+	ref     string
+	results []*RunResult
+}
+
+// Notify satisfies the Notifier interface
+func (n *mockNotifier) Notify(ctx context.Context, result *RunResult) (string, error) {
+	select {
+	case <-time.After(n.delay):
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.results = append(n.results, result)
+	return n.ref, nil
+}
+
+// newMockReporter returns a reporter for the cron backup that sends to notifiers
+func newMockReporter(notifiers ...namedNotifier) *Reporter {
+	return &Reporter{
+		notifiers: notifiers,
+		start:     time.Now(),
+		name:      "backup",
+		stateName: "backup",
+		command:   "backup.sh",
+		hostname:  "host",
+		combined:  bytes.NewBufferString("line 1\nline 2\n"),
+		stdout:    &bytes.Buffer{},
+		stderr:    &bytes.Buffer{},
+		status:    &CmdStatus{ExitCode: 2},
+	}
+}
+
+func (s *Suite) TestReporterFanOut(c *check.C) {
+	first := &mockNotifier{delay: 300 * time.Millisecond}
+	second := &mockNotifier{delay: 300 * time.Millisecond}
+	reporter := newMockReporter(
+		namedNotifier{Notifier: first, name: "first", timeout: time.Second},
+		namedNotifier{Notifier: second, name: "second", timeout: time.Second},
+	)
+
+	start := time.Now()
+	c.Assert(reporter.Finish(errors.New("exit status 2")), check.IsNil)
+	c.Assert(time.Since(start) < 600*time.Millisecond, check.Equals, true)
+
+	c.Assert(first.results, check.HasLen, 1)
+	c.Assert(second.results, check.HasLen, 1)
+	result := first.results[0]
+	c.Assert(result.Name, check.Equals, "backup")
+	c.Assert(result.Host, check.Equals, "host")
+	c.Assert(result.ExitCode, check.Equals, 2)
+	c.Assert(result.Severity, check.Equals, finishLevel)
+	c.Assert(result.Err, check.ErrorMatches, "exit status 2")
+	c.Assert(result.Tail(1), check.Equals, "line 2")
+}
+
+func (s *Suite) TestReporterTimeout(c *check.C) {
+	slow := &mockNotifier{delay: time.Minute}
+	fast := &mockNotifier{}
+	reporter := newMockReporter(
+		namedNotifier{Notifier: slow, name: "slow", timeout: 100 * time.Millisecond},
+		namedNotifier{Notifier: fast, name: "fast", timeout: time.Second},
+	)
+
+	// the error is kept for the errfile if a notifier failed
+	c.Assert(reporter.Finish(errors.New("exit status 2")), check.ErrorMatches, "exit status 2")
+	c.Assert(slow.results, check.HasLen, 0)
+	c.Assert(fast.results, check.HasLen, 1)
+
+	_, err := reporter.notify(reporter.result(errors.New("still running"), warnLevel))
+	c.Assert(err, check.ErrorMatches, "notifiers failed: slow")
+}
+
+func (s *Suite) TestReporterRecovery(c *check.C) {
+	notifier := &mockNotifier{ref: "message-1"}
+	reporter := newMockReporter(namedNotifier{Notifier: notifier, name: "mock", timeout: time.Second})
+	c.Assert(reporter.Finish(errors.New("exit status 2")), check.IsNil)
+
+	notifier.ref = ""
+	reporter = newMockReporter(namedNotifier{Notifier: notifier, name: "mock", timeout: time.Second})
+	c.Assert(reporter.Finish(nil), check.IsNil)
+	c.Assert(notifier.results, check.HasLen, 2)
+	recovered := notifier.results[1]
+	c.Assert(recovered.Severity, check.Equals, recoveredLevel)
+	c.Assert(recovered.Recovery, check.NotNil)
+	c.Assert(recovered.Recovery.FailedRuns, check.Equals, 1)
+	c.Assert(recovered.Recovery.Refs, check.DeepEquals, map[string]string{"mock": "message-1"})
+}
+
+func (s *Suite) TestReporterJobNotifiers(c *check.C) {
+	cr := &CmdRequest{Name: "backup", Status: &CmdStatus{Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}}}
+	cr.Config = &Config{
+		SentryDSN: "http://testuser@localhost/1",
+		Jobs:      map[string]JobConfig{"backup": {Notifiers: []string{}}},
+	}
+	_, err := newReporter(cr)
+	c.Assert(err, check.ErrorMatches, "no notifiers configured")
+
+	cr.Config.Jobs["backup"] = JobConfig{Notifiers: []string{sentryNotifierName}}
+	reporter, err := newReporter(cr)
+	c.Assert(err, check.IsNil)
+	c.Assert(reporter.notifiers, check.HasLen, 1)
+	c.Assert(reporter.notifiers[0].name, check.Equals, sentryNotifierName)
+}
+
+func (s *Suite) TestReporterSilencedRun(c *check.C) {
+	notifier := &mockNotifier{}
+	reporter := newMockReporter(namedNotifier{Notifier: notifier, name: "mock", timeout: time.Second})
+	c.Assert(reporter.Finish(errors.New("exit status 2")), check.IsNil)
+
+	// a silenced failure is no recovery
+	reporter = newMockReporter(namedNotifier{Notifier: notifier, name: "mock", timeout: time.Second})
+	reporter.status.Silenced = "quiet window backup"
+	c.Assert(reporter.Finish(nil), check.IsNil)
+	c.Assert(notifier.results, check.HasLen, 1)
+	c.Assert(notifier.results[0].Severity, check.Equals, finishLevel)
+	state, err := loadJobState(nil, "backup")
+	c.Assert(err, check.IsNil)
+	c.Assert(state.FailedRuns, check.Equals, 1)
+}
+
+func (s *Suite) TestReporterSkippedRun(c *check.C) {
+	notifier := &mockNotifier{}
+	reporter := newMockReporter(namedNotifier{Notifier: notifier, name: "mock", timeout: time.Second})
+	c.Assert(reporter.Finish(errors.New("exit status 2")), check.IsNil)
+
+	// a run skipped by the lock is no recovery
+	reporter = newMockReporter(namedNotifier{Notifier: notifier, name: "mock", timeout: time.Second})
+	reporter.status.Skipped = "cron is still running, pid: 42"
+	c.Assert(reporter.Finish(nil), check.IsNil)
+	c.Assert(notifier.results, check.HasLen, 1)
+	state, err := loadJobState(nil, "backup")
+	c.Assert(err, check.IsNil)
+	c.Assert(state.FailedRuns, check.Equals, 1)
+}
+
+// mockObserver records the runs it is told about
+type mockObserver struct {
+	mockNotifier
+	events chan string
+}
+
+// Started satisfies the runObserver interface
+func (o *mockObserver) Started(ctx context.Context, result *RunResult) {
+	time.Sleep(o.delay)
+	o.events <- "started"
+}
+
+// Finished satisfies the runObserver interface
+func (o *mockObserver) Finished(ctx context.Context, result *RunResult) {
+	o.events <- "finished " + checkInStatus(result)
+}
+
+func (s *Suite) TestReporterStartInBackground(c *check.C) {
+	observer := &mockObserver{mockNotifier: mockNotifier{delay: 300 * time.Millisecond}, events: make(chan string, 2)}
+	reporter := newMockReporter(namedNotifier{Notifier: observer, name: "mock", timeout: time.Second})
+
+	start := time.Now()
+	reporter.Start()
+	c.Assert(time.Since(start) < 100*time.Millisecond, check.Equals, true)
+
+	reporter.status.Skipped = "cron is still running, pid: 42"
+	c.Assert(reporter.Finish(nil), check.IsNil)
+	c.Assert(<-observer.events, check.Equals, "started")
+	c.Assert(<-observer.events, check.Equals, "finished "+checkInError)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Recovery is reported on the first successful run after failed runs
+type Recovery struct {
+	FailedRuns  int
+	FailedSince time.Time
+	Duration    time.Duration     // time between the first failed and the successful run
+	Refs        map[string]string // references of the first notification of the outage by notifier
+}
+
+// Error satisfies the error interface, a recovery is reported like an error
+func (r *Recovery) Error() string {
+	return fmt.Sprintf("recovered after %d failed runs in %s", r.FailedRuns, r.Duration.Round(time.Second))
+}
+
+// trackOutcome keeps the outcome of the run in the job state and returns the
+// recovery if the run succeeded after failed runs. skipped and quiet runs are ignored
+func trackOutcome(c *Config, name string, err error, start time.Time, refs map[string]string) (*Recovery, error) {
+	quietErr := &QuietError{}
+	if errors.As(err, &quietErr) {
+		return nil, nil
+	}
+	var recovery *Recovery
+	_, stateErr := updateJobState(c, name, func(state *jobState) {
+		if err != nil {
+			if state.FailedRuns == 0 {
+				state.FailedSince = start
+			}
+			state.FailedRuns++
+			if state.Refs == nil {
+				state.Refs = map[string]string{}
+			}
+			// keep the first notification, recoveries reply to the start of the outage
+			for notifier, ref := range refs {
+				if _, ok := state.Refs[notifier]; !ok {
+					state.Refs[notifier] = ref
+				}
+			}
+			return
+		}
+		if state.FailedRuns > 0 {
+			recovery = &Recovery{
+				FailedRuns:  state.FailedRuns,
+				FailedSince: state.FailedSince,
+				Duration:    time.Since(state.FailedSince),
+				Refs:        state.Refs,
+			}
+		}
+		state.FailedRuns = 0
+		state.FailedSince = time.Time{}
+		state.Refs = nil
+	})
+	return recovery, stateErr
+}
+
+// sentryAPIURL returns the configured sentry api url, defaults to the host of the dsn
+func sentryAPIURL(config SentryConfig, dsn string) (string, error) {
+	if config.APIURL != "" {
+		return config.APIURL, nil
+	}
+	parsed, err := url.Parse(dsn)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s://%s", parsed.Scheme, parsed.Host), nil
+}
+
+// resolveIssue resolves the sentry issue of the event, requires an api token with event:write
+func resolveIssue(ctx context.Context, client *http.Client, apiURL string, config SentryConfig, eventID string) error {
+	event := struct {
+		GroupID string `json:"groupID"`
+	}{}
+	eventURL := fmt.Sprintf("%s/api/0/projects/%s/%s/events/%s/", apiURL, config.Org, config.Project, eventID)
+	if err := sentryAPI(ctx, client, http.MethodGet, eventURL, config.APIToken, nil, &event); err != nil {
+		return fmt.Errorf("unable to find issue: %s", err)
+	}
+	if event.GroupID == "" {
+		return errors.New("unable to find issue: event has no issue")
+	}
+	issueURL := fmt.Sprintf("%s/api/0/issues/%s/", apiURL, event.GroupID)
+	status := map[string]string{"status": "resolved"}
+	if err := sentryAPI(ctx, client, http.MethodPut, issueURL, config.APIToken, status, nil); err != nil {
+		return fmt.Errorf("unable to resolve issue: %s", err)
+	}
+	log.Info().Str("issue", event.GroupID).Msg("resolved sentry issue")
+	return nil
+}
+
+// sentryAPI sends a request to the sentry web api
+func sentryAPI(ctx context.Context, client *http.Client, method string, url string, token string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	request.Header.Set("Content-Type", "application/json")
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		_, _ = io.Copy(ioutil.Discard, response.Body)
+		return errors.New(response.Status)
+	}
+	if result == nil {
+		_, _ = io.Copy(ioutil.Discard, response.Body)
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestTrackOutcome(c *check.C) {
+	config := &Config{}
+	start := time.Now().Add(-time.Hour)
+
+	recovery, err := trackOutcome(config, "backup", nil, start, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(recovery, check.IsNil)
+
+	for i := 0; i < 3; i++ {
+		recovery, err = trackOutcome(config, "backup", errors.New("exit status 1"), start.Add(time.Duration(i)*time.Minute), map[string]string{"sentry": fmt.Sprintf("event%d", i)})
+		c.Assert(err, check.IsNil)
+		c.Assert(recovery, check.IsNil)
+	}
+
+	// quiet runs do not change the state
+	recovery, err = trackOutcome(config, "backup", &QuietError{Mode: quietSkip}, time.Now(), nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(recovery, check.IsNil)
+
+	recovery, err = trackOutcome(config, "backup", nil, time.Now(), nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(recovery, check.NotNil)
+	c.Assert(recovery.FailedRuns, check.Equals, 3)
+	c.Assert(recovery.FailedSince.Equal(start), check.Equals, true)
+	// the first notification of the outage is kept
+	c.Assert(recovery.Refs, check.DeepEquals, map[string]string{"sentry": "event0"})
+	c.Assert(recovery, check.ErrorMatches, "recovered after 3 failed runs in 1h0m0s")
+
+	recovery, err = trackOutcome(config, "backup", nil, time.Now(), nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(recovery, check.IsNil)
+}
+
+func (s *Suite) TestRecovery(c *check.C) {
+	events := make(chan map[string]interface{}, 2)
+	resolved := make(chan string, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/8/envelope/", func(w http.ResponseWriter, r *http.Request) {
+		event, _ := readEnvelopeEvent(c, r.Body)
+		events <- event
+	})
+	mux.HandleFunc("/api/0/projects/acme/backend/events/", func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Header.Get("Authorization"), check.Equals, "Bearer token")
+		json.NewEncoder(w).Encode(map[string]string{"groupID": "42"})
+	})
+	mux.HandleFunc("/api/0/issues/42/", func(w http.ResponseWriter, r *http.Request) {
+		var status map[string]string
+		json.NewDecoder(r.Body).Decode(&status)
+		resolved <- r.Method + " " + status["status"]
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	os.Setenv("CRONGUARD_SENTRY_DSN", fmt.Sprintf("http://testuser@%s/8", server.Listener.Addr().String()))
+	defer os.Unsetenv("CRONGUARD_SENTRY_DSN")
+
+	newCmdRequest := func() *CmdRequest {
+		cr := &CmdRequest{Name: "backup", Command: "backup.sh", Status: &CmdStatus{}}
+		cr.Status.Stdout = &bytes.Buffer{}
+		cr.Status.Stderr = &bytes.Buffer{}
+		cr.Config = &Config{Sentry: SentryConfig{APIToken: "token", Org: "acme", Project: "backend"}}
+		return cr
+	}
+
+	reporter, err := newReporter(newCmdRequest())
+	c.Assert(err, check.IsNil)
+	c.Assert(reporter.Finish(errors.New("exit status 1")), check.IsNil)
+	failed := <-events
+	c.Assert(failed["level"], check.Equals, "error")
+
+	reporter, err = newReporter(newCmdRequest())
+	c.Assert(err, check.IsNil)
+	c.Assert(reporter.Finish(nil), check.IsNil)
+	recovered := <-events
+	c.Assert(recovered["level"], check.Equals, "info")
+	c.Assert(recovered["message"], check.Matches, ".* \\(recovered\\): backup.sh \\(recovered after 1 failed runs in .*\\)")
+	extra := recovered["extra"].(map[string]interface{})
+	c.Assert(extra["failed_runs"], check.Equals, 1.0)
+	c.Assert(<-resolved, check.Equals, "PUT resolved")
+}
+
+func (s *Suite) TestStateName(c *check.C) {
+	c.Assert((&CmdRequest{Name: "backup", Command: "backup.sh"}).stateName(), check.Equals, "backup")
+
+	// crons without -name are told apart by their command
+	first := &CmdRequest{Name: defaultName, Command: "backup.sh"}
+	second := &CmdRequest{Name: defaultName, Command: "cleanup.sh"}
+	c.Assert(first.stateName(), check.Matches, "cmd-[0-9a-f]{16}")
+	c.Assert(first.stateName(), check.Not(check.Equals), second.stateName())
+	c.Assert(first.stateName(), check.Equals, (&CmdRequest{Command: "backup.sh"}).stateName())
+}
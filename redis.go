@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+type (
+	// redisConn is a minimal client for the redis protocol (RESP2)
+	redisConn struct {
+		conn net.Conn
+		r    *bufio.Reader
+	}
+
+	// redisError is an error reply of the redis server
+	redisError string
+)
+
+// redisTimeout is the timeout for connecting and every command
+var redisTimeout = 5 * time.Second
+
+// Error satisfies the error interface
+func (e redisError) Error() string {
+	return fmt.Sprintf("redis: %s", string(e))
+}
+
+// dialRedis connects to addr and authenticates if a password is given
+func dialRedis(ctx context.Context, addr string, password string, db int) (*redisConn, error) {
+	dialer := net.Dialer{Timeout: redisTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to redis: %s", err)
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if password != "" {
+		if _, err := c.do("AUTH", password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if db != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(db)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Close closes the connection
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+// do sends a command and reads the reply. replies are string, int64, nil for
+// null replies, []interface{} for arrays or a redisError
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(redisTimeout)); err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(c.conn)
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, fmt.Errorf("unable to send redis command: %s", err)
+	}
+	reply, err := readRESP(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if redisErr, ok := reply.(redisError); ok {
+		return nil, redisErr
+	}
+	return reply, nil
+}
+
+// readRESP reads a single reply
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("unable to read redis reply: %s", err)
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("invalid redis reply")
+	}
+	kind, value := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return redisError(value), nil
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("unable to read redis reply: %s", err)
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		array := make([]interface{}, n)
+		for i := range array {
+			if array[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	default:
+		return nil, fmt.Errorf("invalid redis reply type '%c'", kind)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type (
+	// RulePack bundles the known failure patterns, benign noise and exit codes of a tool
+	RulePack struct {
+		Patterns  []string         `yaml:"patterns"`
+		Ignore    []string         `yaml:"ignore"`
+		ExitCodes map[int]ExitCode `yaml:"exit_codes"`
+	}
+
+	// ExitCode describes the meaning of an exit code
+	ExitCode struct {
+		Meaning string `yaml:"meaning"`
+		OK      bool   `yaml:"ok"`
+		Pack    string `yaml:"-"` // rule pack that defined the exit code
+	}
+
+	// Rules are the compiled rule packs selected for a cron
+	Rules struct {
+		Patterns  []rule
+		Ignore    []rule
+		ExitCodes map[int]ExitCode
+	}
+
+	// rule is a single compiled pattern of a rule pack
+	rule struct {
+		Pack  string
+		Regex *regexp.Regexp
+	}
+)
+
+// builtinRulePacks are the rule packs shipped with cronguard
+var builtinRulePacks = map[string]RulePack{
+	"rsync": {
+		Patterns: []string{
+			`^rsync error: `,
+			`^rsync: .*(failed|error)`,
+			`(?i)no space left on device`,
+		},
+		Ignore: []string{
+			`^file has vanished: `,
+			`^rsync warning: some files vanished before they could be transferred`,
+			`^skipping non-regular file `,
+		},
+		ExitCodes: map[int]ExitCode{
+			1:  {Meaning: "syntax or usage error"},
+			2:  {Meaning: "protocol incompatibility"},
+			3:  {Meaning: "errors selecting input/output files, dirs"},
+			5:  {Meaning: "error starting client-server protocol"},
+			10: {Meaning: "error in socket I/O"},
+			11: {Meaning: "error in file I/O"},
+			12: {Meaning: "error in rsync protocol data stream"},
+			20: {Meaning: "received SIGUSR1 or SIGINT"},
+			23: {Meaning: "partial transfer due to error"},
+			24: {Meaning: "partial transfer due to vanished source files", OK: true},
+			30: {Meaning: "timeout in data send/receive"},
+			35: {Meaning: "timeout waiting for daemon connection"},
+		},
+	},
+	"mysqldump": {
+		Patterns: []string{
+			`^mysqldump: (Got error|Couldn't|Error)`,
+			`^mysqldump: \[ERROR\]`,
+		},
+		Ignore: []string{
+			`^(mysqldump: \[Warning\] )?Using a password on the command line interface can be insecure\.$`,
+			`^Warning: Using a password on the command line interface can be insecure\.$`,
+		},
+		ExitCodes: map[int]ExitCode{
+			1: {Meaning: "usage error"},
+			2: {Meaning: "mysql error"},
+			3: {Meaning: "consistency check error"},
+			4: {Meaning: "out of memory"},
+			5: {Meaning: "unable to write result file"},
+			6: {Meaning: "illegal table"},
+		},
+	},
+	"pg_dump": {
+		Patterns: []string{
+			`^pg_dump: (error|fatal|FATAL|ERROR):`,
+			`^pg_dump: \[.*\] `,
+		},
+		Ignore: []string{
+			`^pg_dump: warning: there are circular foreign-key constraints`,
+			`^pg_dump: detail: `,
+			`^pg_dump: hint: `,
+		},
+		ExitCodes: map[int]ExitCode{
+			1: {Meaning: "dump failed"},
+		},
+	},
+	"borg": {
+		Patterns: []string{
+			`^terminating with error status`,
+			`^Failed to create/acquire the lock`,
+		},
+		Ignore: []string{
+			`: file changed while we backed it up$`,
+			`^terminating with warning status, rc 1$`,
+		},
+		ExitCodes: map[int]ExitCode{
+			1: {Meaning: "finished with warnings", OK: true},
+			2: {Meaning: "error"},
+		},
+	},
+	"restic": {
+		Patterns: []string{
+			`^Fatal: `,
+			`^error: `,
+		},
+		Ignore: []string{
+			`^using parent snapshot `,
+			`^(open|repository|created restic) repository `,
+		},
+		ExitCodes: map[int]ExitCode{
+			1:  {Meaning: "command failed"},
+			3:  {Meaning: "source data could not be read, incomplete snapshot created"},
+			10: {Meaning: "repository does not exist"},
+			11: {Meaning: "failed to lock repository"},
+			12: {Meaning: "wrong password"},
+		},
+	},
+	"apt": {
+		Patterns: []string{
+			`^E: `,
+			`^Err:\d+ `,
+		},
+		Ignore: []string{
+			`^W: `,
+			`^N: `,
+			`^WARNING: apt does not have a stable CLI interface`,
+			`^debconf: `,
+		},
+		ExitCodes: map[int]ExitCode{
+			100: {Meaning: "apt error"},
+		},
+	},
+	"certbot": {
+		Patterns: []string{
+			`^An unexpected error occurred`,
+			`^Failed to renew certificate `,
+			`^All renewal attempts failed`,
+		},
+		Ignore: []string{
+			`^Saving debug log to `,
+			`^Processing /etc/letsencrypt/renewal/`,
+			`^Certificate not yet due for renewal`,
+			`^Cert not yet due for renewal`,
+			`^No renewals were attempted\.`,
+			`^(- )+-?$`,
+		},
+		ExitCodes: map[int]ExitCode{
+			1: {Meaning: "certbot error"},
+		},
+	},
+	"logrotate": {
+		Patterns: []string{
+			`^error: `,
+		},
+		Ignore: []string{
+			`^reading config file `,
+			`^Reading state from file: `,
+			`^Allocating hash table for state file`,
+			`^Handling \d+ logs$`,
+			`^(rotating pattern|considering log|  log does not need rotating|  Now: |  Last rotated at )`,
+		},
+		ExitCodes: map[int]ExitCode{
+			1: {Meaning: "logrotate error"},
+		},
+	},
+}
+
+// compileRules merges the builtin rule packs with the configured ones and compiles the selected packs. like
+// the patterns the first selected pack wins if several packs define the same exit code
+func compileRules(names []string, configured map[string]RulePack) (*Rules, error) {
+	rules := &Rules{ExitCodes: map[int]ExitCode{}}
+	for _, name := range names {
+		builtin, isBuiltin := builtinRulePacks[name]
+		extension, isConfigured := configured[name]
+		if !isBuiltin && !isConfigured {
+			return nil, fmt.Errorf("unknown rule pack '%s', available: %s", name, strings.Join(rulePackNames(configured), ", "))
+		}
+		for _, pack := range []RulePack{builtin, extension} {
+			for _, pattern := range pack.Patterns {
+				regex, err := regexp.Compile(pattern)
+				if err != nil {
+					return nil, fmt.Errorf("invalid pattern in rule pack '%s': %s", name, err)
+				}
+				rules.Patterns = append(rules.Patterns, rule{Pack: name, Regex: regex})
+			}
+			for _, pattern := range pack.Ignore {
+				regex, err := regexp.Compile(pattern)
+				if err != nil {
+					return nil, fmt.Errorf("invalid ignore pattern in rule pack '%s': %s", name, err)
+				}
+				rules.Ignore = append(rules.Ignore, rule{Pack: name, Regex: regex})
+			}
+			for code, meaning := range pack.ExitCodes {
+				if defined, ok := rules.ExitCodes[code]; ok && defined.Pack != name {
+					continue
+				}
+				meaning.Pack = name
+				rules.ExitCodes[code] = meaning
+			}
+		}
+	}
+	return rules, nil
+}
+
+// rulePackNames returns the sorted names of all builtin and configured rule packs
+func rulePackNames(configured map[string]RulePack) []string {
+	names := []string{}
+	for name := range builtinRulePacks {
+		names = append(names, name)
+	}
+	for name := range configured {
+		if _, ok := builtinRulePacks[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ignored returns the matching ignore rule for line
+func (r *Rules) ignored(line []byte) *rule {
+	if r == nil {
+		return nil
+	}
+	for i, ignore := range r.Ignore {
+		if ignore.Regex.Match(line) {
+			return &r.Ignore[i]
+		}
+	}
+	return nil
+}
+
+// matched returns the matching failure rule for line
+func (r *Rules) matched(line []byte) *rule {
+	if r == nil {
+		return nil
+	}
+	for i, pattern := range r.Patterns {
+		if pattern.Regex.Match(line) {
+			return &r.Patterns[i]
+		}
+	}
+	return nil
+}
+
+// String satisfies fmt.Stringer
+func (r rule) String() string {
+	return fmt.Sprintf("%s: %s", r.Pack, r.Regex)
+}
+
+// exitCode returns the meaning of an exit code
+func (r *Rules) exitCode(code int) (ExitCode, bool) {
+	if r == nil {
+		return ExitCode{}, false
+	}
+	exitCode, ok := r.ExitCodes[code]
+	return exitCode, ok
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestCompileRules(c *check.C) {
+	_, err := compileRules([]string{"unknown"}, nil)
+	c.Assert(err, check.ErrorMatches, "unknown rule pack 'unknown', available: apt, borg, .*")
+
+	_, err = compileRules([]string{"custom"}, map[string]RulePack{"custom": {Patterns: []string{"("}}})
+	c.Assert(err, check.ErrorMatches, "invalid pattern in rule pack 'custom': .*")
+
+	configured := map[string]RulePack{
+		"rsync": {
+			Ignore:    []string{`^sending incremental file list$`},
+			ExitCodes: map[int]ExitCode{23: {Meaning: "expected", OK: true}},
+		},
+		"custom": {
+			Patterns: []string{`^ABORT`},
+		},
+	}
+	rules, err := compileRules([]string{"rsync", "custom"}, configured)
+	c.Assert(err, check.IsNil)
+	c.Assert(rules.ignored([]byte("sending incremental file list")), check.NotNil)
+	c.Assert(rules.ignored([]byte("file has vanished: /tmp/x")), check.NotNil)
+	c.Assert(rules.ignored([]byte("sent 1 bytes")), check.IsNil)
+	c.Assert(rules.matched([]byte("ABORT now")).Pack, check.Equals, "custom")
+	c.Assert(rules.matched([]byte("rsync error: broken pipe")).String(), check.Equals, "rsync: ^rsync error: ")
+	c.Assert(rules.ExitCodes[23], check.DeepEquals, ExitCode{Meaning: "expected", OK: true, Pack: "rsync"})
+	c.Assert(rules.ExitCodes[24].OK, check.Equals, true)
+
+	// the first selected pack wins on the same exit code
+	rules, err = compileRules([]string{"borg", "restic"}, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(rules.ExitCodes[1], check.DeepEquals, ExitCode{Meaning: "finished with warnings", OK: true, Pack: "borg"})
+	c.Assert(rules.ExitCodes[3].Pack, check.Equals, "restic")
+	rules, err = compileRules([]string{"restic", "borg"}, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(rules.ExitCodes[1], check.DeepEquals, ExitCode{Meaning: "command failed", Pack: "restic"})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// semaphore is a named host wide semaphore with a number of slots, every
+	// slot is a lockfile in the runtime directory
+	semaphore struct {
+		Name  string
+		Slots int
+	}
+)
+
+// parseSemaphore parses 'name:slots'
+func parseSemaphore(s string) (*semaphore, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || strings.ContainsAny(parts[0], "/.") {
+		return nil, fmt.Errorf("invalid semaphore '%s', format 'name:slots'", s)
+	}
+	slots, err := strconv.Atoi(parts[1])
+	if err != nil || slots < 1 {
+		return nil, fmt.Errorf("invalid semaphore slots '%s'", parts[1])
+	}
+	return &semaphore{Name: parts[0], Slots: slots}, nil
+}
+
+// String satisfies fmt.Stringer
+func (s *semaphore) String() string {
+	return fmt.Sprintf("%s:%d", s.Name, s.Slots)
+}
+
+// acquire tries to get one of the slots without blocking, lock is nil if all slots are taken
+func (s *semaphore) acquire(c *Config, info lockInfo) (Lock, error) {
+	dir := filepath.Join(c.runtimeDir(), "semaphores")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create semaphore directory: %s", err)
+	}
+	for slot := 0; slot < s.Slots; slot++ {
+		path := filepath.Join(dir, fmt.Sprintf("%s.%d.lock", s.Name, slot))
+		lock, _, err := acquireFileLock(path, info)
+		if err != nil {
+			return nil, err
+		}
+		if lock != nil {
+			return lock, nil
+		}
+	}
+	return nil, nil
+}
+
+// SemaphoreWaitError is returned if no slot was free within the semaphore wait time
+type SemaphoreWaitError struct {
+	Wait      time.Duration
+	Semaphore *semaphore
+}
+
+// Error satisfies the error interface
+func (e *SemaphoreWaitError) Error() string {
+	return fmt.Sprintf("semaphore wait timed out after %s, all %d slots of %s are taken", e.Wait, e.Semaphore.Slots, e.Semaphore.Name)
+}
+
+// wait retries to get a slot until one is free or wait expires
+func (s *semaphore) wait(ctx context.Context, c *Config, info lockInfo, wait time.Duration) (Lock, error) {
+	deadline := time.After(wait)
+	ticker := time.NewTicker(lockPollInterval)
+	defer ticker.Stop()
+	for {
+		lock, err := s.acquire(c, info)
+		if err != nil || lock != nil {
+			return lock, err
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return nil, &SemaphoreWaitError{Wait: wait, Semaphore: s}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestParseSemaphore(c *check.C) {
+	sem, err := parseSemaphore("heavy-io:2")
+	c.Assert(err, check.IsNil)
+	c.Assert(sem, check.DeepEquals, &semaphore{Name: "heavy-io", Slots: 2})
+	c.Assert(sem.String(), check.Equals, "heavy-io:2")
+
+	for _, invalid := range []string{"heavy-io", "heavy-io:0", "heavy-io:x", ":2", "../etc:2"} {
+		_, err = parseSemaphore(invalid)
+		c.Assert(err, check.NotNil, check.Commentf("semaphore %s", invalid))
+	}
+}
+
+func (s *Suite) TestSemaphore(c *check.C) {
+	os.Setenv("CRONGUARD_RUNTIME_DIR", c.MkDir())
+	defer os.Unsetenv("CRONGUARD_RUNTIME_DIR")
+	config := &Config{}
+	sem := &semaphore{Name: "heavy-io", Slots: 2}
+
+	first, err := sem.acquire(config, lockInfo{PID: 1})
+	c.Assert(err, check.IsNil)
+	c.Assert(first, check.NotNil)
+	second, err := sem.acquire(config, lockInfo{PID: 2})
+	c.Assert(err, check.IsNil)
+	c.Assert(second, check.NotNil)
+	third, err := sem.acquire(config, lockInfo{PID: 3})
+	c.Assert(err, check.IsNil)
+	c.Assert(third, check.IsNil)
+
+	_, err = sem.wait(context.Background(), config, lockInfo{PID: 3}, 100*time.Millisecond)
+	c.Assert(err, check.ErrorMatches, "semaphore wait timed out after 100ms, all 2 slots of heavy-io are taken")
+
+	go func() {
+		<-time.After(300 * time.Millisecond)
+		second.Release()
+	}()
+	third, err = sem.wait(context.Background(), config, lockInfo{PID: 3}, 5*time.Second)
+	c.Assert(err, check.IsNil)
+	c.Assert(third, check.NotNil)
+	c.Assert(first.Release(), check.IsNil)
+	c.Assert(third.Release(), check.IsNil)
+}
@@ -1,17 +1,17 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha256"
-	"crypto/tls"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash"
-	"io"
 	stdlog "log"
 	"net/http"
 	"os"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/getsentry/sentry-go"
@@ -19,22 +19,41 @@ import (
 )
 
 type (
-	Reporter struct {
+	// sentryNotifier reports run results as sentry events
+	sentryNotifier struct {
 		sentryDSN string
-		start     time.Time
 		hostname  string
 		cmd       string
 		hash      hash.Hash
 
-		combined *bytes.Buffer
-		stderr   *bytes.Buffer
+		dsn       *sentry.Dsn
+		client    *http.Client
+		monitor   *Monitor
+		checkInID string
+
+		fingerprint []*template.Template
+		config      SentryConfig
+
+		envelopes         *envelopeTransport
+		attachmentMaxSize int
+		summaryLines      int
+	}
+
+	// fingerprintData is available in the fingerprint templates
+	fingerprintData struct {
+		Name     string
+		Host     string
+		Command  string
+		ExitCode int
+		Level    string
 	}
 )
 
+// SentryTimeout is the default timeout to send reports if no http timeout is configured
 var SentryTimeout = 30 * time.Second
 
-// newReporter creates a new Sentry client
-func newReporter(cr *CmdRequest) (*Reporter, error) {
+// newSentryNotifier creates a new Sentry client
+func newSentryNotifier(cr *CmdRequest) (*sentryNotifier, error) {
 	sentryDSN, ok := os.LookupEnv("CRONGUARD_SENTRY_DSN")
 	if !ok && cr.Config != nil {
 		sentryDSN = cr.Config.SentryDSN
@@ -44,11 +63,16 @@ func newReporter(cr *CmdRequest) (*Reporter, error) {
 	}
 
 	// data
+	sentryConfig := cr.Config.sentryConfig()
+	job := cr.Config.job(cr.Name)
 	hostname, _ := os.Hostname()
 	if hostname == "" {
 		hostname = "no-hostname"
 	}
 	hostname = strings.SplitN(hostname, ".", 2)[0]
+	if sentryConfig.ServerName != "" {
+		hostname = sentryConfig.ServerName
+	}
 	hash := sha256.New()
 	hash.Write([]byte(cr.Command))
 	hash.Write([]byte(hostname))
@@ -57,20 +81,43 @@ func newReporter(cr *CmdRequest) (*Reporter, error) {
 		cmd = fmt.Sprintf("%s%s", cmd[0:30], "...")
 	}
 
+	dsn, err := sentry.NewDsn(sentryDSN)
+	if err != nil {
+		fmt.Fprintf(cr.Status.Stderr, "cronguard: unable to connect to sentry: %s\n", err)
+		fmt.Fprintf(cr.Status.Stderr, "cronguard: running cron anyways\n")
+		return nil, fmt.Errorf("unable to connect to sentry")
+	}
+
+	fingerprint := sentryConfig.Fingerprint
+	if len(job.Fingerprint) > 0 {
+		fingerprint = job.Fingerprint
+	}
+	fingerprintTemplates, err := compileFingerprint(fingerprint)
+	if err != nil {
+		fmt.Fprintf(cr.Status.Stderr, "cronguard: invalid sentry fingerprint, using default: %s\n", err)
+	}
+
 	// setup sentry
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-		},
+	httpConfig := cr.Config.httpConfig()
+	transport, err := httpConfig.transport()
+	if err != nil {
+		fmt.Fprintf(cr.Status.Stderr, "cronguard: unable to connect to sentry: %s\n", err)
+		fmt.Fprintf(cr.Status.Stderr, "cronguard: running cron anyways\n")
+		return nil, fmt.Errorf("unable to connect to sentry")
 	}
+	envelopes := &envelopeTransport{spool: newSpool(cr.Config), timeout: sentryConfig.timeout(httpConfig)}
 	sentryErr := sentry.Init(sentry.ClientOptions{
 		Debug:         cr.Debug,
 		HTTPTransport: transport,
+		Transport:     envelopes,
 		BeforeSend: func(event *sentry.Event, hint *sentry.EventHint) *sentry.Event {
 			log.Debug().Interface("event", event).Msg("sending event")
 			return event
 		},
-		Dsn: sentryDSN,
+		Dsn:         sentryDSN,
+		Environment: sentryConfig.Environment,
+		Release:     sentryConfig.Release,
+		ServerName:  sentryConfig.ServerName,
 	})
 	if sentryErr != nil {
 		fmt.Fprintf(cr.Status.Stderr, "cronguard: unable to connect to sentry: %s\n", sentryErr)
@@ -78,84 +125,235 @@ func newReporter(cr *CmdRequest) (*Reporter, error) {
 		return nil, fmt.Errorf("unable to connect to sentry")
 	}
 
-	// wrap buffers
-	start := time.Now()
-	combined := bytes.NewBuffer([]byte{})
-	stderr := bytes.NewBuffer([]byte{})
-	cr.Status.Stderr = io.MultiWriter(stderr, combined, cr.Status.Stderr)
-	cr.Status.Stdout = io.MultiWriter(combined, cr.Status.Stdout)
-
-	// set known sentry extras
+	// set known sentry tags
 	sentry.ConfigureScope(func(scope *sentry.Scope) {
-		scope.SetExtra("time_start", start)
-		scope.SetExtra("command", cr.Command)
+		scope.SetTags(sentryConfig.Tags)
+		scope.SetTags(job.Tags)
 	})
 
 	if cr.Debug {
 		sentry.Logger = stdlog.Default()
 	}
 
-	return &Reporter{
+	return &sentryNotifier{
 		sentryDSN: sentryDSN,
-		start:     start,
 		hostname:  hostname,
 		cmd:       cmd,
 		hash:      hash,
-		combined:  combined,
-		stderr:    stderr,
+		dsn:       dsn,
+		client:    &http.Client{Transport: transport},
+		monitor:   cronMonitor(cr),
+		checkInID: newCheckInID(),
+
+		fingerprint: fingerprintTemplates,
+		config:      sentryConfig,
+
+		envelopes:         envelopes,
+		attachmentMaxSize: sentryConfig.attachmentMaxSize(),
+		summaryLines:      sentryConfig.summaryLines(),
 	}, nil
 }
 
-// Finish reports the final status to sentry if err != nil
-func (r *Reporter) Finish(err error) error {
-	if err == nil {
-		return nil
-	}
-	return r.report(err, finishLevel)
+// Started sends the in progress check-in if the cron has a monitor
+func (s *sentryNotifier) Started(ctx context.Context, result *RunResult) {
+	s.checkIn(ctx, checkInProgress, result)
 }
 
-// Info reports a Info status to sentry
-func (r *Reporter) Info(err error) error {
-	return r.report(err, infoLevel)
+// Finished sends the final check-in if the cron has a monitor and delivers the
+// spooled reports, every run retries them, not only failed ones
+func (s *sentryNotifier) Finished(ctx context.Context, result *RunResult) {
+	s.checkIn(ctx, checkInStatus(result), result)
+	s.flushSpool(ctx)
+}
+
+// checkIn sends a Sentry Crons check-in, failed check-ins do not fail the cron
+func (s *sentryNotifier) checkIn(ctx context.Context, status string, result *RunResult) {
+	if s.monitor == nil {
+		return
+	}
+	c := s.monitor.newCheckIn(s.checkInID, status, time.Since(result.Start))
+	if err := sendCheckIn(ctx, s.client, s.dsn, c); err != nil {
+		log.Warn().Err(err).Str("monitor", s.monitor.Slug).Msg("check-in failed")
+	}
 }
 
-// reportLevel is used by reporter to disingques
-type reportLevel = string
+// Notify reports the result as sentry event, the event id is the reference
+func (s *sentryNotifier) Notify(ctx context.Context, result *RunResult) (string, error) {
+	eventID := s.report(result)
 
-const (
-	// infoLevel is an information that will be send to sentry
-	infoLevel reportLevel = "info"
-	// finishLevel is used to tell the reporter that the cron has finished
-	finishLevel = "finish"
-)
+	timeout := SentryTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	if !sentry.Flush(timeout) {
+		return "", errors.New("unable to flush events to sentry")
+	}
+	if result.Recovery != nil {
+		s.resolve(ctx, result.Recovery)
+	}
+	return eventID, nil
+}
 
-// report reports any error message to sentry
-func (r *Reporter) report(err error, level reportLevel) error {
+// report captures the sentry event of the result
+func (s *sentryNotifier) report(result *RunResult) string {
 	// prepare sentry information
+	err := result.Err
+	level := result.Severity
 	name := ""
-	extra := map[string]interface{}{}
+	extra := map[string]interface{}{
+		"time_start": result.Start,
+		"command":    result.Command,
+	}
+	exceptions := []sentry.Exception{}
 	if level == finishLevel {
-		name = fmt.Sprintf("%s: %s (%s)", r.hostname, r.cmd, err.Error())
-		extra["time_end"] = time.Now()
-		extra["time_duration"] = time.Since(r.start).String()
-		extra["out_combined"] = r.combined.String()
-		extra["out_stderr"] = r.stderr.String()
+		name = fmt.Sprintf("%s: %s (%s)", s.hostname, s.cmd, err.Error())
 	} else {
-		name = fmt.Sprintf("%s (%s): %s (%s)", r.hostname, level, r.cmd, err.Error())
+		name = fmt.Sprintf("%s (%s): %s (%s)", s.hostname, level, s.cmd, err.Error())
+	}
+	if level == finishLevel || level == downgradeLevel {
+		extra["time_end"] = result.End
+		extra["time_duration"] = result.Duration().String()
+		// the full output is attached, extras are truncated by sentry
+		extra["out_tail"] = result.Tail(s.summaryLines)
+		s.envelopes.attach(
+			gzipAttachment("combined.log", []byte(result.Output), s.attachmentMaxSize),
+			gzipAttachment("stdout.log", []byte(result.Stdout), s.attachmentMaxSize),
+			gzipAttachment("stderr.log", []byte(result.Stderr), s.attachmentMaxSize),
+		)
+		if result.LockWaited > 0 {
+			extra["lock_wait"] = result.LockWaited.String()
+		}
+		if result.SemaphoreWaited > 0 {
+			extra["semaphore_wait"] = result.SemaphoreWaited.String()
+		}
+		outErr := &OutputError{}
+		if errors.As(err, &outErr) {
+			extra["out_first_bad_line"] = outErr.Line
+			if outErr.First != "" {
+				extra["out_first_bad_line"] = outErr.First
+			}
+		}
+		if errors.As(err, &outErr) && outErr.Log != nil {
+			extra["log_level"] = outErr.Log.Level
+			extra["log_msg"] = outErr.Log.Message
+			extra["log_error"] = outErr.Log.Error
+			extra["log_fields"] = outErr.Log.Fields
+		}
+		exceptions = parseTracebacks(result.Stderr)
+	}
+	if result.Recovery != nil {
+		extra["failed_runs"] = result.Recovery.FailedRuns
+		extra["failed_since"] = result.Recovery.FailedSince
+		extra["outage_duration"] = result.Recovery.Duration.String()
 	}
 
 	// sentry
-	hash := hex.EncodeToString(r.hash.Sum([]byte(level)))
-	sentry.ConfigureScope(func(scope *sentry.Scope) {
-		scope.SetFingerprint([]string{hash})
-		scope.SetExtras(extra)
-	})
-	_ = sentry.CaptureMessage(name)
+	hash := hex.EncodeToString(s.hash.Sum([]byte(level)))
+	fingerprint := []string{hash}
+	if len(exceptions) > 0 {
+		// group crashes by their stack trace instead of the command
+		fingerprint = []string{"{{ default }}"}
+	}
+	if len(s.fingerprint) > 0 {
+		fingerprint = s.renderFingerprint(result, fingerprint)
+	}
+	// set on the event, the global scope would carry them over to the next event
+	event := sentry.NewEvent()
+	event.Message = name
+	event.Exception = exceptions
+	event.Level = sentryLevel(level)
+	event.Fingerprint = fingerprint
+	event.Extra = extra
+	if eventID := sentry.CaptureEvent(event); eventID != nil {
+		return string(*eventID)
+	}
+	return ""
+}
+
+// resolve resolves the sentry issue of the first failed run if an api token is configured
+func (s *sentryNotifier) resolve(ctx context.Context, recovery *Recovery) {
+	eventID := recovery.Refs[sentryNotifierName]
+	if s.config.APIToken == "" || eventID == "" {
+		return
+	}
+	apiURL, err := sentryAPIURL(s.config, s.sentryDSN)
+	if err != nil {
+		log.Warn().Err(err).Msg("invalid sentry api url")
+		return
+	}
+	if err := resolveIssue(ctx, s.client, apiURL, s.config, eventID); err != nil {
+		log.Warn().Err(err).Msg("unable to resolve sentry issue")
+	}
+}
+
+// flushSpool delivers reports of earlier runs once sentry is reachable again
+func (s *sentryNotifier) flushSpool(ctx context.Context) {
+	if s.envelopes.spool == nil {
+		return
+	}
+	delivered, err := s.envelopes.spool.flush(ctx, s.client)
+	if err != nil {
+		log.Warn().Err(err).Msg("unable to flush spool")
+	}
+	if delivered > 0 {
+		log.Info().Int("reports", delivered).Msg("delivered spooled reports")
+	}
+}
+
+// tailLines returns the last n lines of output
+func tailLines(output string, n int) string {
+	lines := strings.SplitAfter(strings.TrimRight(output, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "")
+}
+
+// compileFingerprint parses the fingerprint templates, '{{ default }}' is kept for sentry's default grouping
+func compileFingerprint(fingerprint []string) ([]*template.Template, error) {
+	funcs := template.FuncMap{
+		"default": func() string { return "{{ default }}" },
+	}
+	templates := []*template.Template{}
+	for _, part := range fingerprint {
+		t, err := template.New("fingerprint").Funcs(funcs).Parse(part)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+// renderFingerprint renders the fingerprint templates, fallback is used if a template fails
+func (s *sentryNotifier) renderFingerprint(result *RunResult, fallback []string) []string {
+	data := fingerprintData{
+		Name:     result.Name,
+		Host:     s.hostname,
+		Command:  s.cmd,
+		ExitCode: result.ExitCode,
+		Level:    severity(result.Severity),
+	}
+	fingerprint := []string{}
+	for _, t := range s.fingerprint {
+		part := &strings.Builder{}
+		if err := t.Execute(part, data); err != nil {
+			log.Warn().Err(err).Msg("unable to render sentry fingerprint")
+			return fallback
+		}
+		fingerprint = append(fingerprint, part.String())
+	}
+	return fingerprint
+}
 
-	// hide error if messages are successfully flushed to sentry
-	flushed := sentry.Flush(SentryTimeout)
-	if !flushed {
-		return err
+// sentryLevel maps a reportLevel to the sentry event level
+func sentryLevel(level reportLevel) sentry.Level {
+	switch level {
+	case infoLevel, downgradeLevel, recoveredLevel:
+		return sentry.LevelInfo
+	case warnLevel:
+		return sentry.LevelWarning
+	default:
+		return sentry.LevelError
 	}
-	return nil
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+// testEnvelopeItem is an item of an envelope received by a test server
+type testEnvelopeItem struct {
+	Header  map[string]interface{}
+	Payload []byte
+}
+
+// readEnvelope parses the items of an envelope
+func readEnvelope(c *check.C, r io.Reader) []testEnvelopeItem {
+	reader := bufio.NewReader(r)
+	_, err := reader.ReadBytes('\n')
+	c.Assert(err, check.IsNil)
+	items := []testEnvelopeItem{}
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return items
+		}
+		c.Assert(err, check.IsNil)
+		item := testEnvelopeItem{}
+		c.Assert(json.Unmarshal(line, &item.Header), check.IsNil)
+		item.Payload = make([]byte, int(item.Header["length"].(float64))+1)
+		_, err = io.ReadFull(reader, item.Payload)
+		c.Assert(err, check.IsNil)
+		item.Payload = item.Payload[:len(item.Payload)-1]
+		items = append(items, item)
+	}
+}
+
+// readEnvelopeEvent returns the event and attachments of an envelope
+func readEnvelopeEvent(c *check.C, r io.Reader) (event map[string]interface{}, attachments map[string]string) {
+	attachments = map[string]string{}
+	for _, item := range readEnvelope(c, r) {
+		switch item.Header["type"] {
+		case "event":
+			c.Assert(json.Unmarshal(item.Payload, &event), check.IsNil)
+		case "attachment":
+			gz, err := gzip.NewReader(bytes.NewReader(item.Payload))
+			c.Assert(err, check.IsNil)
+			data, err := ioutil.ReadAll(gz)
+			c.Assert(err, check.IsNil)
+			attachments[item.Header["filename"].(string)] = string(data)
+		}
+	}
+	return event, attachments
+}
+
+func (s *Suite) TestSentryConfig(c *check.C) {
+	events := make(chan map[string]interface{}, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/6/envelope/", func(w http.ResponseWriter, r *http.Request) {
+		event, _ := readEnvelopeEvent(c, r.Body)
+		events <- event
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	os.Setenv("CRONGUARD_SENTRY_DSN", fmt.Sprintf("http://testuser@%s/6", server.Listener.Addr().String()))
+	defer os.Unsetenv("CRONGUARD_SENTRY_DSN")
+
+	cr := &CmdRequest{Name: "backup", Command: "backup.sh", Status: &CmdStatus{ExitCode: 23}}
+	cr.Status.Stdout = &bytes.Buffer{}
+	cr.Status.Stderr = &bytes.Buffer{}
+	cr.Config = &Config{
+		Sentry: SentryConfig{
+			Environment: "production",
+			ServerName:  "web1",
+			Tags:        map[string]string{"team": "ops", "service": "web"},
+			Fingerprint: []string{"{{.Name}}"},
+		},
+		Jobs: map[string]JobConfig{
+			"backup": {
+				Tags:        map[string]string{"team": "db"},
+				Fingerprint: []string{"{{.Name}}", "{{.ExitCode}}", "{{ default }}"},
+			},
+		},
+	}
+	reporter, err := newReporter(cr)
+	c.Assert(err, check.IsNil)
+	c.Assert(reporter.Finish(errors.New("exit status 23")), check.IsNil)
+
+	event := <-events
+	c.Assert(event["environment"], check.Equals, "production")
+	c.Assert(event["server_name"], check.Equals, "web1")
+	c.Assert(event["message"], check.Equals, "web1: backup.sh (exit status 23)")
+	c.Assert(event["tags"], check.DeepEquals, map[string]interface{}{"team": "db", "service": "web"})
+	c.Assert(event["fingerprint"], check.DeepEquals, []interface{}{"backup", "23", "{{ default }}"})
+	c.Assert(event["level"], check.Equals, "error")
+	c.Assert(event["extra"], check.Not(check.IsNil))
+	c.Assert(event["extra"].(map[string]interface{})["out_tail"], check.NotNil)
+
+	// extras and level of the failure do not leak into the next event
+	c.Assert(reporter.Warn(errors.New("slow")), check.IsNil)
+	event = <-events
+	c.Assert(event["level"], check.Equals, "warning")
+	_, ok := event["extra"].(map[string]interface{})["out_tail"]
+	c.Assert(ok, check.Equals, false)
+
+	_, err = compileFingerprint([]string{"{{.Name"})
+	c.Assert(err, check.NotNil)
+}
+
+func (s *Suite) TestSentryFingerprintLevel(c *check.C) {
+	fingerprint, err := compileFingerprint([]string{"{{.Name}}", "{{.Level}}"})
+	c.Assert(err, check.IsNil)
+	notifier := &sentryNotifier{fingerprint: fingerprint}
+	// templates see the public names, not the internal levels
+	for level, name := range map[reportLevel]string{finishLevel: "error", downgradeLevel: "info", warnLevel: "warning"} {
+		result := &RunResult{Name: "backup", Severity: level}
+		c.Assert(notifier.renderFingerprint(result, nil), check.DeepEquals, []string{"backup", name})
+	}
+}
+
+func (s *Suite) TestAttachments(c *check.C) {
+	a := gzipAttachment("combined.log", []byte("1\n2\n3\n4\n"), 4)
+	c.Assert(a.Filename, check.Equals, "combined.log.gz")
+	gz, err := gzip.NewReader(bytes.NewReader(a.Data))
+	c.Assert(err, check.IsNil)
+	data, err := ioutil.ReadAll(gz)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "[cronguard: truncated 4 bytes]\n3\n4\n")
+
+	c.Assert(tailLines("1\n2\n3\n4\n", 2), check.Equals, "3\n4")
+	c.Assert(tailLines("1\n2", 5), check.Equals, "1\n2")
+}
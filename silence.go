@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+type (
+	// Silence is a runtime silence for all crons whose name matches Job
+	Silence struct {
+		ID        string    `json:"id"`
+		Job       string    `json:"job"`
+		Mode      string    `json:"mode"`
+		Reason    string    `json:"reason"`
+		CreatedBy string    `json:"created_by"`
+		Created   time.Time `json:"created"`
+		Until     time.Time `json:"until"`
+	}
+)
+
+// silenceRetention is the time expired silences are kept for the record
+const silenceRetention = 7 * 24 * time.Hour
+
+// String returns who silenced the cron and why
+func (s *Silence) String() string {
+	str := fmt.Sprintf("silence %s by %s until %s", s.ID, s.CreatedBy, s.Until.Format(time.RFC3339))
+	if s.Reason != "" {
+		str = fmt.Sprintf("%s (%s)", str, s.Reason)
+	}
+	return str
+}
+
+// matches checks if the silence is active for the cron name at now
+func (s *Silence) matches(name string, now time.Time) bool {
+	if !now.Before(s.Until) {
+		return false
+	}
+	job, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", s.Job))
+	if err != nil {
+		return false
+	}
+	return job.MatchString(name)
+}
+
+// silenceDir returns the directory of the silence records
+func silenceDir(c *Config) string {
+	return filepath.Join(c.stateDir(), "silences")
+}
+
+// loadSilences reads all silence records, a missing directory means there are none
+func loadSilences(c *Config) ([]*Silence, error) {
+	dir := silenceDir(c)
+	files, err := ioutil.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []*Silence{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read silences: %s", err)
+	}
+	silences := []*Silence{}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read silence: %s", err)
+		}
+		silence := &Silence{}
+		if err := json.Unmarshal(data, silence); err != nil {
+			return nil, fmt.Errorf("unable to parse silence %s: %s", file.Name(), err)
+		}
+		silences = append(silences, silence)
+	}
+	sort.Slice(silences, func(i, j int) bool {
+		return silences[i].Created.Before(silences[j].Created)
+	})
+	return silences, nil
+}
+
+// writeSilence creates or updates a silence record
+func writeSilence(c *Config, silence *Silence) error {
+	dir := silenceDir(c)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("unable to create silence directory: %s", err)
+	}
+	data, err := json.MarshalIndent(silence, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write atomically, running crons may read the silence at any time
+	path := filepath.Join(dir, silence.ID+".json")
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("unable to write silence: %s", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// activeSilence returns the first active silence for the cron or nil
+func activeSilence(cr *CmdRequest, now time.Time) (*Silence, error) {
+	silences, err := loadSilences(cr.Config)
+	if err != nil {
+		return nil, err
+	}
+	for _, silence := range silences {
+		if silence.matches(cr.Name, now) {
+			return silence, nil
+		}
+	}
+	return nil, nil
+}
+
+// silenceCmd manages runtime silences, usage: silence add|list|expire
+func silenceCmd(args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing action, use 'add', 'list' or 'expire'")
+	}
+	config := ParseConfig()
+	switch args[0] {
+	case "add":
+		return silenceAdd(config, args[1:])
+	case "list":
+		return silenceList(config, args[1:])
+	case "expire":
+		return silenceExpire(config, args[1:])
+	default:
+		return fmt.Errorf("unknown action '%s', use 'add', 'list' or 'expire'", args[0])
+	}
+}
+
+// silenceAdd creates a new silence
+func silenceAdd(config *Config, args []string) error {
+	f := flag.NewFlagSet("silence add", flag.ExitOnError)
+	job := f.String("job", "", "regex for the cron names to silence")
+	duration := f.Duration("for", 0, "duration of the silence")
+	reason := f.String("reason", "", "reason for the silence")
+	mode := f.String("mode", quietSilence, "'silence' to suppress alerts, 'downgrade' to report as info or 'skip' to not run crons")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	if *job == "" || *duration <= 0 {
+		return errors.New("-job and -for are required")
+	}
+	if _, err := regexp.Compile(*job); err != nil {
+		return fmt.Errorf("invalid job regex: %s", err)
+	}
+	if err := validQuietMode(*mode); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	silence := &Silence{
+		ID:        xid.New().String(),
+		Job:       *job,
+		Mode:      *mode,
+		Reason:    *reason,
+		CreatedBy: currentUser(),
+		Created:   now,
+		Until:     now.Add(*duration),
+	}
+	if err := writeSilence(config, silence); err != nil {
+		return err
+	}
+	cleanupSilences(config, now)
+	fmt.Println(silence.ID)
+	return nil
+}
+
+// silenceList prints the active silences
+func silenceList(config *Config, args []string) error {
+	f := flag.NewFlagSet("silence list", flag.ExitOnError)
+	all := f.Bool("all", false, "include expired silences")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	silences, err := loadSilences(config)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tJOB\tMODE\tUNTIL\tBY\tREASON\n")
+	for _, silence := range silences {
+		if !*all && !now.Before(silence.Until) {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			silence.ID, silence.Job, silence.Mode, silence.Until.Format(time.RFC3339), silence.CreatedBy, silence.Reason,
+		)
+	}
+	return w.Flush()
+}
+
+// silenceExpire ends silences by id or job regex
+func silenceExpire(config *Config, args []string) error {
+	f := flag.NewFlagSet("silence expire", flag.ExitOnError)
+	job := f.String("job", "", "expire all silences with exactly this job regex")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	ids := map[string]bool{}
+	for _, id := range f.Args() {
+		ids[id] = true
+	}
+	if *job == "" && len(ids) == 0 {
+		return errors.New("silence ids or -job required")
+	}
+	silences, err := loadSilences(config)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	expired := 0
+	for _, silence := range silences {
+		if !ids[silence.ID] && (*job == "" || silence.Job != *job) {
+			continue
+		}
+		if now.Before(silence.Until) {
+			silence.Until = now
+			if err := writeSilence(config, silence); err != nil {
+				return err
+			}
+		}
+		delete(ids, silence.ID)
+		expired++
+	}
+	if len(ids) > 0 {
+		missing := []string{}
+		for id := range ids {
+			missing = append(missing, id)
+		}
+		sort.Strings(missing)
+		return fmt.Errorf("no silence with id %s", strings.Join(missing, ", "))
+	}
+	fmt.Printf("expired %d silences\n", expired)
+	return nil
+}
+
+// cleanupSilences removes expired silence records after the retention time
+func cleanupSilences(config *Config, now time.Time) {
+	silences, err := loadSilences(config)
+	if err != nil {
+		return
+	}
+	for _, silence := range silences {
+		if now.Sub(silence.Until) > silenceRetention {
+			_ = os.Remove(filepath.Join(silenceDir(config), silence.ID+".json"))
+		}
+	}
+}
+
+// currentUser returns the user that runs cronguard, the original user if run via sudo
+func currentUser() string {
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
+		return sudoUser
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "unknown"
+}
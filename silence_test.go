@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestSilences(c *check.C) {
+	dir := c.MkDir()
+	os.Setenv("CRONGUARD_STATE_DIR", dir)
+	defer os.Unsetenv("CRONGUARD_STATE_DIR")
+	config := &Config{}
+
+	silences, err := loadSilences(config)
+	c.Assert(err, check.IsNil)
+	c.Assert(silences, check.HasLen, 0)
+
+	err = silenceCmd([]string{"add", "-job", "backup.*", "-for", "2h", "-reason", "migration", "-mode", "skip"})
+	c.Assert(err, check.IsNil)
+	err = silenceCmd([]string{"add", "-job", "backup.*", "-reason", "migration"})
+	c.Assert(err, check.ErrorMatches, "-job and -for are required")
+
+	cr := &CmdRequest{Config: config, Name: "backup-db"}
+	silence, err := activeSilence(cr, time.Now())
+	c.Assert(err, check.IsNil)
+	c.Assert(silence, check.NotNil)
+	c.Assert(silence.Mode, check.Equals, quietSkip)
+	c.Assert(silence.Reason, check.Equals, "migration")
+	c.Assert(silence.CreatedBy, check.Not(check.Equals), "")
+	c.Assert(silence.String(), check.Matches, "silence .* by .* until .* \\(migration\\)")
+
+	cr.Name = "other-backup-db"
+	silence, err = activeSilence(cr, time.Now())
+	c.Assert(err, check.IsNil)
+	c.Assert(silence, check.IsNil)
+
+	cr.Name = "backup-db"
+	silence, err = activeSilence(cr, time.Now().Add(3*time.Hour))
+	c.Assert(err, check.IsNil)
+	c.Assert(silence, check.IsNil)
+
+	err = silenceCmd([]string{"expire", "unknown"})
+	c.Assert(err, check.ErrorMatches, "no silence with id unknown")
+	err = silenceCmd([]string{"expire", "-job", "backup.*"})
+	c.Assert(err, check.IsNil)
+	silence, err = activeSilence(cr, time.Now())
+	c.Assert(err, check.IsNil)
+	c.Assert(silence, check.IsNil)
+
+	err = silenceCmd([]string{"list", "-all"})
+	c.Assert(err, check.IsNil)
+}
+
+func TestSilenceOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cronguard-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("CRONGUARD_STATE_DIR", dir)
+	defer os.Unsetenv("CRONGUARD_STATE_DIR")
+
+	err = silenceCmd([]string{"add", "-job", "silenced", "-for", "1h", "-reason", "maintenance", "-mode", "downgrade"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	silences, err := loadSilences(&Config{})
+	if err != nil || len(silences) != 1 {
+		t.Fatalf("unable to load silence: %v", err)
+	}
+	want := "// silenced: " + silences[0].String() + "\n// error: exit status 1 (" + silences[0].String() + ")\n"
+	err = guard(t, []string{"-name", "silenced"}, "false", want)
+	if err != nil {
+		t.Error(err)
+	}
+	err = guard(t, []string{"-name", "not-silenced"}, "false", "// error: exit status 1\n")
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type (
+	// slackNotifier posts formatted messages to Slack or Mattermost
+	slackNotifier struct {
+		name    string
+		webhook *webhookNotifier
+		token   string
+		apiURL  string
+		client  *http.Client
+
+		channel   string
+		username  string
+		iconEmoji string
+		mentions  []string
+		mentionOn []string
+		lines     int
+	}
+
+	// slackMessage is the payload of incoming webhooks and chat.postMessage
+	slackMessage struct {
+		Channel     string            `json:"channel,omitempty"`
+		Username    string            `json:"username,omitempty"`
+		IconEmoji   string            `json:"icon_emoji,omitempty"`
+		Text        string            `json:"text"`
+		ThreadTS    string            `json:"thread_ts,omitempty"`
+		Attachments []slackAttachment `json:"attachments,omitempty"`
+	}
+
+	// slackAttachment is a coloured block of the message, supported by Slack and Mattermost
+	slackAttachment struct {
+		Fallback string       `json:"fallback"`
+		Color    string       `json:"color"`
+		Title    string       `json:"title"`
+		Text     string       `json:"text,omitempty"`
+		Fields   []slackField `json:"fields,omitempty"`
+		Footer   string       `json:"footer,omitempty"`
+		TS       int64        `json:"ts"`
+		MrkdwnIn []string     `json:"mrkdwn_in,omitempty"`
+	}
+
+	// slackField is a field of an attachment
+	slackField struct {
+		Title string `json:"title"`
+		Value string `json:"value"`
+		Short bool   `json:"short"`
+	}
+
+	// slackResponse is the response of the slack api
+	slackResponse struct {
+		OK      bool   `json:"ok"`
+		Error   string `json:"error"`
+		Channel string `json:"channel"`
+		TS      string `json:"ts"`
+	}
+)
+
+// defaultSlackAPIURL is the url of the slack api if a token is used
+const defaultSlackAPIURL = "https://slack.com/api"
+
+// slackColors are the attachment colors by severity
+var slackColors = map[reportLevel]string{
+	finishLevel:    "#d50200",
+	downgradeLevel: "#de9e31",
+	warnLevel:      "#de9e31",
+	infoLevel:      "#439fe0",
+	recoveredLevel: "#2eb886",
+}
+
+// slackVerbs describe the severity in the message
+var slackVerbs = map[reportLevel]string{
+	finishLevel:    "failed",
+	downgradeLevel: "failed in a quiet window",
+	warnLevel:      "warning",
+	infoLevel:      "info",
+	recoveredLevel: "recovered",
+}
+
+// newSlackNotifier creates a slack notifier, the settings of the job replace the configured ones
+func newSlackNotifier(httpConfig HTTPConfig, name string, config SlackConfig, job SlackJobConfig) (*slackNotifier, error) {
+	if job.Channel != "" {
+		config.Channel = job.Channel
+	}
+	if job.Username != "" {
+		config.Username = job.Username
+	}
+	if job.Mentions != nil {
+		config.Mentions = job.Mentions
+	}
+	if job.MentionOn != nil {
+		config.MentionOn = job.MentionOn
+	}
+	if config.MentionOn == nil {
+		config.MentionOn = []string{severity(finishLevel)}
+	}
+	for _, on := range config.MentionOn {
+		if !validSeverity(on) {
+			return nil, fmt.Errorf("invalid mention_on '%s', use error, warning, info or recovered", on)
+		}
+	}
+	if config.Lines <= 0 {
+		config.Lines = defaultSummaryLines
+	}
+
+	transport, err := httpConfig.transport()
+	if err != nil {
+		return nil, err
+	}
+	notifier := &slackNotifier{
+		name:      name,
+		token:     config.Token,
+		apiURL:    strings.TrimRight(config.APIURL, "/"),
+		client:    &http.Client{Transport: transport},
+		channel:   config.Channel,
+		username:  config.Username,
+		iconEmoji: config.IconEmoji,
+		mentions:  config.Mentions,
+		mentionOn: config.MentionOn,
+		lines:     config.Lines,
+	}
+	switch {
+	case config.Token != "":
+		if config.Channel == "" {
+			return nil, errors.New("slack token requires a channel")
+		}
+		if notifier.apiURL == "" {
+			notifier.apiURL = defaultSlackAPIURL
+		}
+	case config.URL != "":
+		notifier.webhook = &webhookNotifier{url: config.URL, method: http.MethodPost, client: notifier.client}
+	default:
+		return nil, errors.New("slack requires an url or a token")
+	}
+	return notifier, nil
+}
+
+// Notify posts the message, with a token the channel and timestamp of the message
+// are the reference to reply to it on recovery
+func (s *slackNotifier) Notify(ctx context.Context, result *RunResult) (string, error) {
+	message := s.message(result)
+	if s.webhook != nil {
+		body, err := json.Marshal(message)
+		if err != nil {
+			return "", err
+		}
+		return "", s.webhook.deliver(ctx, body)
+	}
+	if result.Recovery != nil {
+		ref := strings.SplitN(result.Recovery.Refs[s.name], "/", 2)
+		if len(ref) == 2 {
+			message.Channel, message.ThreadTS = ref[0], ref[1]
+		}
+	}
+	return s.postMessage(ctx, message)
+}
+
+// message formats the result
+func (s *slackNotifier) message(result *RunResult) *slackMessage {
+	verb, ok := slackVerbs[result.Severity]
+	if !ok {
+		verb = result.Severity
+	}
+	text := fmt.Sprintf("*%s* %s on %s", slackEscape(result.Name), verb, slackEscape(result.Host))
+	if mentions := s.mention(result); mentions != "" {
+		text = mentions + " " + text
+	}
+
+	errText := ""
+	if result.Err != nil {
+		errText = result.Err.Error()
+	}
+	attachment := slackAttachment{
+		Fallback: fmt.Sprintf("%s %s on %s: %s", result.Name, verb, result.Host, errText),
+		Color:    slackColors[result.Severity],
+		Title:    slackEscape(errText),
+		Fields: []slackField{
+			{Title: "Host", Value: slackEscape(result.Host), Short: true},
+			{Title: "Job", Value: slackEscape(result.Name), Short: true},
+			{Title: "Exit Code", Value: fmt.Sprintf("%d", result.ExitCode), Short: true},
+			{Title: "Duration", Value: result.Duration().Round(time.Millisecond).String(), Short: true},
+		},
+		Footer:   "cronguard",
+		TS:       result.End.Unix(),
+		MrkdwnIn: []string{"text"},
+	}
+	if result.UUID != "" {
+		attachment.Footer = fmt.Sprintf("cronguard %s", result.UUID)
+	}
+	if result.Recovery != nil {
+		attachment.Fields = []slackField{
+			{Title: "Host", Value: slackEscape(result.Host), Short: true},
+			{Title: "Job", Value: slackEscape(result.Name), Short: true},
+			{Title: "Failed Runs", Value: fmt.Sprintf("%d", result.Recovery.FailedRuns), Short: true},
+			{Title: "Outage", Value: result.Recovery.Duration.Round(time.Second).String(), Short: true},
+		}
+	}
+	if tail := result.Tail(s.lines); tail != "" && (result.Severity == finishLevel || result.Severity == downgradeLevel) {
+		// long attachments are collapsed by Slack and Mattermost
+		attachment.Text = fmt.Sprintf("```\n%s\n```", strings.ReplaceAll(slackEscape(tail), "```", "` ` `"))
+	}
+
+	return &slackMessage{
+		Channel:     s.channel,
+		Username:    s.username,
+		IconEmoji:   s.iconEmoji,
+		Text:        text,
+		Attachments: []slackAttachment{attachment},
+	}
+}
+
+// mention returns the mentions if the severity of the result is mentioned
+func (s *slackNotifier) mention(result *RunResult) string {
+	for _, on := range s.mentionOn {
+		if on == severity(result.Severity) {
+			return strings.Join(s.mentions, " ")
+		}
+	}
+	return ""
+}
+
+// postMessage sends the message using chat.postMessage of the slack api
+func (s *slackNotifier) postMessage(ctx context.Context, message *slackMessage) (string, error) {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return "", err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, s.apiURL+"/chat.postMessage", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Authorization", "Bearer "+s.token)
+	request.Header.Set("Content-Type", "application/json; charset=utf-8")
+	response, err := s.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return "", errors.New(response.Status)
+	}
+	result := &slackResponse{}
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		return "", fmt.Errorf("invalid slack response: %s", err)
+	}
+	if !result.OK {
+		return "", fmt.Errorf("slack api error: %s", result.Error)
+	}
+	return result.Channel + "/" + result.TS, nil
+}
+
+// validSeverity checks if name is a public severity
+func validSeverity(name string) bool {
+	for _, s := range severities {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// slackEscape escapes the control characters of slack messages
+func slackEscape(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestSlackWebhook(c *check.C) {
+	messages := make(chan slackMessage, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		message := slackMessage{}
+		c.Check(json.NewDecoder(r.Body).Decode(&message), check.IsNil)
+		messages <- message
+	}))
+	defer server.Close()
+
+	config := SlackConfig{
+		URL:            server.URL,
+		SlackJobConfig: SlackJobConfig{Channel: "#ops", Username: "cron", Mentions: []string{"@here"}},
+	}
+	job := SlackJobConfig{Channel: "#db", Mentions: []string{"@dba"}}
+	notifier, err := newSlackNotifier(HTTPConfig{}, "chat", config, job)
+	c.Assert(err, check.IsNil)
+
+	result := newWebhookResult()
+	result.Output = "dumping <db>\ndisk full\n"
+	ref, err := notifier.Notify(context.Background(), result)
+	c.Assert(err, check.IsNil)
+	c.Assert(ref, check.Equals, "")
+	message := <-messages
+	c.Assert(message.Channel, check.Equals, "#db")
+	c.Assert(message.Username, check.Equals, "cron")
+	c.Assert(message.Text, check.Equals, "@dba *backup* failed on db1")
+	c.Assert(message.Attachments, check.HasLen, 1)
+	attachment := message.Attachments[0]
+	c.Assert(attachment.Color, check.Equals, "#d50200")
+	c.Assert(attachment.Title, check.Equals, "exit status 3")
+	c.Assert(attachment.Text, check.Equals, "```\ndumping &lt;db&gt;\ndisk full\n```")
+	c.Assert(attachment.Footer, check.Equals, "cronguard c5k2")
+	c.Assert(attachment.Fields, check.DeepEquals, []slackField{
+		{Title: "Host", Value: "db1", Short: true},
+		{Title: "Job", Value: "backup", Short: true},
+		{Title: "Exit Code", Value: "3", Short: true},
+		{Title: "Duration", Value: "1m30s", Short: true},
+	})
+
+	// warnings do not mention and have no output
+	result.Severity = warnLevel
+	_, err = notifier.Notify(context.Background(), result)
+	c.Assert(err, check.IsNil)
+	message = <-messages
+	c.Assert(message.Text, check.Equals, "*backup* warning on db1")
+	c.Assert(message.Attachments[0].Color, check.Equals, "#de9e31")
+	c.Assert(message.Attachments[0].Text, check.Equals, "")
+
+	// failures downgraded in quiet windows are info
+	notifier, err = newSlackNotifier(HTTPConfig{}, "chat", config, SlackJobConfig{MentionOn: []string{"info"}})
+	c.Assert(err, check.IsNil)
+	result.Severity = downgradeLevel
+	_, err = notifier.Notify(context.Background(), result)
+	c.Assert(err, check.IsNil)
+	message = <-messages
+	c.Assert(message.Text, check.Equals, "@here *backup* failed in a quiet window on db1")
+}
+
+func (s *Suite) TestSlackThreadedRecovery(c *check.C) {
+	messages := make(chan slackMessage, 3)
+	posted := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, check.Equals, "/api/chat.postMessage")
+		c.Check(r.Header.Get("Authorization"), check.Equals, "Bearer xoxb-token")
+		message := slackMessage{}
+		c.Check(json.NewDecoder(r.Body).Decode(&message), check.IsNil)
+		messages <- message
+		posted++
+		json.NewEncoder(w).Encode(slackResponse{OK: true, Channel: "C42", TS: fmt.Sprintf("1700000000.00010%d", posted)})
+	}))
+	defer server.Close()
+
+	cr := &CmdRequest{Name: "backup", Command: "backup.sh", Status: &CmdStatus{}}
+	cr.Status.Stdout = &bytes.Buffer{}
+	cr.Status.Stderr = &bytes.Buffer{}
+	cr.Config = &Config{Notifiers: map[string]NotifierConfig{
+		"chat": {Slack: &SlackConfig{
+			Token:          "xoxb-token",
+			APIURL:         server.URL + "/api/",
+			SlackJobConfig: SlackJobConfig{Channel: "#ops"},
+		}},
+	}}
+
+	reporter, err := newReporter(cr)
+	c.Assert(err, check.IsNil)
+	c.Assert(reporter.Finish(errors.New("exit status 1")), check.IsNil)
+	failed := <-messages
+	c.Assert(failed.Channel, check.Equals, "#ops")
+	c.Assert(failed.ThreadTS, check.Equals, "")
+	reporter, err = newReporter(cr)
+	c.Assert(err, check.IsNil)
+	c.Assert(reporter.Finish(errors.New("exit status 1")), check.IsNil)
+	<-messages
+
+	reporter, err = newReporter(cr)
+	c.Assert(err, check.IsNil)
+	c.Assert(reporter.Finish(nil), check.IsNil)
+	recovered := <-messages
+	c.Assert(recovered.Channel, check.Equals, "C42")
+	// the recovery replies to the first failure
+	c.Assert(recovered.ThreadTS, check.Equals, "1700000000.000101")
+	c.Assert(recovered.Text, check.Equals, "*backup* recovered on "+reporter.hostname)
+	c.Assert(recovered.Attachments[0].Color, check.Equals, "#2eb886")
+	c.Assert(recovered.Attachments[0].Fields[2], check.DeepEquals, slackField{Title: "Failed Runs", Value: "2", Short: true})
+}
+
+func (s *Suite) TestSlackErrors(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(slackResponse{OK: false, Error: "channel_not_found"})
+	}))
+	defer server.Close()
+
+	notifier, err := newSlackNotifier(HTTPConfig{}, "chat", SlackConfig{
+		Token:          "xoxb-token",
+		APIURL:         server.URL,
+		SlackJobConfig: SlackJobConfig{Channel: "#missing"},
+	}, SlackJobConfig{})
+	c.Assert(err, check.IsNil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = notifier.Notify(ctx, newWebhookResult())
+	c.Assert(err, check.ErrorMatches, "slack api error: channel_not_found")
+
+	_, err = newSlackNotifier(HTTPConfig{}, "chat", SlackConfig{Token: "xoxb-token"}, SlackJobConfig{})
+	c.Assert(err, check.ErrorMatches, "slack token requires a channel")
+	_, err = newSlackNotifier(HTTPConfig{}, "chat", SlackConfig{}, SlackJobConfig{})
+	c.Assert(err, check.ErrorMatches, "slack requires an url or a token")
+	_, err = newSlackNotifier(HTTPConfig{}, "chat", SlackConfig{URL: "http://localhost"}, SlackJobConfig{MentionOn: []string{"finish"}})
+	c.Assert(err, check.ErrorMatches, "invalid mention_on 'finish', use error, warning, info or recovered")
+}
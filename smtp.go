@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type (
+	// mailNotifier sends an email for failed crons like cron does with MAILTO
+	mailNotifier struct {
+		addr       string
+		username   string
+		password   string
+		requireTLS bool
+		tls        *tls.Config
+		from       string
+		to         []string
+		subject    *template.Template
+		body       *template.Template
+		lines      int
+	}
+)
+
+// defaultMailLines is the number of output lines in the mail
+const defaultMailLines = 100
+
+// defaultMailSubject is the subject of the mail if none is configured
+const defaultMailSubject = `cronguard: {{.Name}} on {{.Host}} failed ({{.Error}})`
+
+// defaultMailBody is the body of the mail if none is configured
+const defaultMailBody = `{{.Command}} failed on {{.Host}}
+
+error:     {{.Error}}
+exit code: {{.ExitCode}}
+started:   {{.Start.Format "2006-01-02 15:04:05 MST"}}
+duration:  {{.Duration}}
+{{- if .UUID}}
+uuid:      {{.UUID}}{{end}}
+
+{{if .Tail}}last lines of the output:
+
+{{.Tail}}
+{{else}}no output
+{{end}}`
+
+// errNoRecipients disables the mail notifier, an empty MAILTO turns the mails off
+var errNoRecipients = errors.New("no mail recipients")
+
+// newMailNotifier creates a mail notifier. the recipients are the ones of the job,
+// the MAILTO variable of the crontab or the configured ones, in that order
+func newMailNotifier(httpConfig HTTPConfig, config SMTPConfig, mailTo []string) (*mailNotifier, error) {
+	if config.Addr == "" {
+		return nil, errors.New("smtp requires an addr")
+	}
+	if _, _, err := net.SplitHostPort(config.Addr); err != nil {
+		return nil, fmt.Errorf("invalid smtp addr: %s", err)
+	}
+	tlsConfig, err := httpConfig.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	to := config.To
+	if env, ok := os.LookupEnv("MAILTO"); ok {
+		// an empty MAILTO disables mails like in the crontab
+		to = splitMailTo(env)
+	}
+	if mailTo != nil {
+		to = mailTo
+	}
+
+	from := config.From
+	if from == "" {
+		hostname, _ := os.Hostname()
+		from = fmt.Sprintf("cronguard@%s", hostname)
+	}
+	subject, err := parseMailTemplate("subject", config.Subject, defaultMailSubject)
+	if err != nil {
+		return nil, err
+	}
+	body, err := parseMailTemplate("body", config.Body, defaultMailBody)
+	if err != nil {
+		return nil, err
+	}
+	lines := config.Lines
+	if lines <= 0 {
+		lines = defaultMailLines
+	}
+	if len(to) == 0 {
+		return nil, errNoRecipients
+	}
+	return &mailNotifier{
+		addr:       config.Addr,
+		username:   config.Username,
+		password:   config.Password,
+		requireTLS: config.RequireTLS,
+		tls:        tlsConfig,
+		from:       from,
+		to:         to,
+		subject:    subject,
+		body:       body,
+		lines:      lines,
+	}, nil
+}
+
+// parseMailTemplate parses the configured template, fallback is used if none is configured
+func parseMailTemplate(name string, text string, fallback string) (*template.Template, error) {
+	if text == "" {
+		text = fallback
+	}
+	t, err := template.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid smtp %s: %s", name, err)
+	}
+	return t, nil
+}
+
+// splitMailTo splits the recipients of a MAILTO variable
+func splitMailTo(mailTo string) []string {
+	to := []string{}
+	for _, rcpt := range strings.Split(mailTo, ",") {
+		if rcpt = strings.TrimSpace(rcpt); rcpt != "" {
+			to = append(to, rcpt)
+		}
+	}
+	return to
+}
+
+// Notify sends a mail if the cron failed, other results are ignored
+func (m *mailNotifier) Notify(ctx context.Context, result *RunResult) (string, error) {
+	if result.Severity != finishLevel {
+		return "", nil
+	}
+	message, err := m.message(result)
+	if err != nil {
+		return "", err
+	}
+	return "", m.send(ctx, message)
+}
+
+// message renders the mail of the result
+func (m *mailNotifier) message(result *RunResult) ([]byte, error) {
+	data := result.data(m.lines)
+	subject := &strings.Builder{}
+	if err := m.subject.Execute(subject, data); err != nil {
+		return nil, fmt.Errorf("unable to render mail subject: %s", err)
+	}
+	body := &bytes.Buffer{}
+	if err := m.body.Execute(body, data); err != nil {
+		return nil, fmt.Errorf("unable to render mail body: %s", err)
+	}
+
+	message := &bytes.Buffer{}
+	header := func(key string, value string) {
+		fmt.Fprintf(message, "%s: %s\r\n", key, value)
+	}
+	header("From", m.from)
+	header("To", strings.Join(m.to, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", strings.Join(strings.Fields(subject.String()), " ")))
+	header("Date", result.End.Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	// the output may contain long lines and any bytes, 8bit is not supported by every server
+	header("Content-Transfer-Encoding", "quoted-printable")
+	if result.UUID != "" {
+		header("X-Cronguard-UUID", result.UUID)
+	}
+	message.WriteString("\r\n")
+	qp := quotedprintable.NewWriter(message)
+	if _, err := qp.Write(body.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return message.Bytes(), nil
+}
+
+// send delivers the message to the smtp server
+func (m *mailNotifier) send(ctx context.Context, message []byte) error {
+	host, _, _ := net.SplitHostPort(m.addr)
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", m.addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		tlsConfig := m.tls.Clone()
+		tlsConfig.ServerName = host
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("starttls failed: %s", err)
+		}
+	} else if m.requireTLS {
+		return errors.New("smtp server does not support STARTTLS")
+	}
+	if m.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.username, m.password, host)); err != nil {
+			return fmt.Errorf("smtp auth failed: %s", err)
+		}
+	}
+
+	if err := client.Mail(m.from); err != nil {
+		return err
+	}
+	for _, rcpt := range m.to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("recipient %s rejected: %s", rcpt, err)
+		}
+	}
+	data, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := data.Write(message); err != nil {
+		return err
+	}
+	if err := data.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+// testMail is a mail received by the test smtp server
+type testMail struct {
+	TLS  bool
+	Auth string
+	From string
+	To   []string
+	Data string
+}
+
+// newTestSMTPServer starts a minimal smtp server that supports AUTH PLAIN and STARTTLS if tlsConfig
+// is set, the mails are sent to the channel. the server stops if the listener is closed
+func newTestSMTPServer(c *check.C, tlsConfig *tls.Config) (net.Listener, chan testMail) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	mails := make(chan testMail, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSMTP(conn, tlsConfig, mails)
+		}
+	}()
+	return listener, mails
+}
+
+// serveTestSMTP handles a single smtp connection
+func serveTestSMTP(conn net.Conn, tlsConfig *tls.Config, mails chan testMail) {
+	defer func() { conn.Close() }()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+	reply("220 localhost ESMTP test")
+	mail := testMail{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch command {
+		case "EHLO":
+			reply("250-localhost")
+			if tlsConfig != nil && !mail.TLS {
+				reply("250-STARTTLS")
+			}
+			reply("250 AUTH PLAIN")
+		case "STARTTLS":
+			reply("220 ready to start TLS")
+			upgraded := tls.Server(conn, tlsConfig)
+			if err := upgraded.Handshake(); err != nil {
+				return
+			}
+			conn, reader = upgraded, bufio.NewReader(upgraded)
+			mail = testMail{TLS: true}
+		case "AUTH":
+			auth, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(line, "AUTH PLAIN "))
+			mail.Auth = strings.ReplaceAll(string(auth), "\x00", ":")
+			reply("235 ok")
+		case "MAIL":
+			mail.From = strings.Trim(strings.TrimPrefix(line, "MAIL FROM:"), "<>")
+			reply("250 ok")
+		case "RCPT":
+			rcpt := strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>")
+			if strings.HasPrefix(rcpt, "unknown@") {
+				reply("550 no such user")
+				continue
+			}
+			mail.To = append(mail.To, rcpt)
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			data := &strings.Builder{}
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			mail.Data = data.String()
+			mails <- mail
+			mail = testMail{TLS: mail.TLS}
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (s *Suite) TestMailNotifier(c *check.C) {
+	listener, mails := newTestSMTPServer(c, nil)
+	defer listener.Close()
+	os.Unsetenv("MAILTO")
+
+	notifier, err := newMailNotifier(HTTPConfig{}, SMTPConfig{
+		Addr:     listener.Addr().String(),
+		Username: "cron",
+		Password: "secret",
+		From:     "cron@example.com",
+		To:       []string{"ops@example.com"},
+	}, nil)
+	c.Assert(err, check.IsNil)
+
+	// only failures are sent
+	result := newWebhookResult()
+	for _, level := range []reportLevel{infoLevel, warnLevel, downgradeLevel, recoveredLevel} {
+		result.Severity = level
+		_, err = notifier.Notify(context.Background(), result)
+		c.Assert(err, check.IsNil)
+	}
+	c.Assert(mails, check.HasLen, 0)
+
+	_, err = notifier.Notify(context.Background(), newWebhookResult())
+	c.Assert(err, check.IsNil)
+	mail := <-mails
+	c.Assert(mail.TLS, check.Equals, false)
+	c.Assert(mail.Auth, check.Equals, ":cron:secret")
+	c.Assert(mail.From, check.Equals, "cron@example.com")
+	c.Assert(mail.To, check.DeepEquals, []string{"ops@example.com"})
+	c.Assert(mail.Data, check.Matches, "(?s)From: cron@example.com\r\nTo: ops@example.com\r\n.*")
+	c.Assert(mail.Data, check.Matches, "(?s).*Subject: cronguard: backup on db1 failed \\(exit status 3\\)\r\n.*")
+	c.Assert(mail.Data, check.Matches, "(?s).*X-Cronguard-UUID: c5k2\r\n.*")
+	c.Assert(mail.Data, check.Matches, "(?s).*Content-Transfer-Encoding: quoted-printable\r\n.*")
+	c.Assert(mail.Data, check.Matches, "(?s).*exit code: 3\r\n.*duration:  1m30s\r\n.*")
+	c.Assert(mail.Data, check.Matches, "(?s).*last lines of the output:\r\n\r\ndumping\r\ndisk full\r\n$")
+
+	// rejected recipients fail the notification
+	notifier.to = []string{"unknown@example.com"}
+	_, err = notifier.Notify(context.Background(), newWebhookResult())
+	c.Assert(err, check.ErrorMatches, "recipient unknown@example.com rejected: 550 .no such user.")
+
+	// the server does not support STARTTLS
+	notifier.requireTLS = true
+	_, err = notifier.Notify(context.Background(), newWebhookResult())
+	c.Assert(err, check.ErrorMatches, "smtp server does not support STARTTLS")
+}
+
+func (s *Suite) TestMailNotifierTemplate(c *check.C) {
+	listener, mails := newTestSMTPServer(c, nil)
+	defer listener.Close()
+	addr := listener.Addr().String()
+	os.Unsetenv("MAILTO")
+
+	notifier, err := newMailNotifier(HTTPConfig{}, SMTPConfig{
+		Addr:    addr,
+		To:      []string{"ops@example.com"},
+		Subject: "[{{.Host}}] {{.Name}}",
+		Body:    "{{.Error}}\n{{tail 1 .Output}}\n",
+	}, nil)
+	c.Assert(err, check.IsNil)
+	_, err = notifier.Notify(context.Background(), newWebhookResult())
+	c.Assert(err, check.IsNil)
+	mail := <-mails
+	c.Assert(mail.Data, check.Matches, "(?s).*Subject: \\[db1\\] backup\r\n.*\r\n\r\nexit status 3\r\ndisk full\r\n$")
+
+	_, err = newMailNotifier(HTTPConfig{}, SMTPConfig{Addr: addr, Subject: "{{.Name"}, nil)
+	c.Assert(err, check.ErrorMatches, "invalid smtp subject: .*")
+	_, err = newMailNotifier(HTTPConfig{}, SMTPConfig{Addr: "localhost"}, nil)
+	c.Assert(err, check.ErrorMatches, "invalid smtp addr: .*")
+}
+
+func (s *Suite) TestMailNotifierStartTLS(c *check.C) {
+	// borrow the test certificate of httptest
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	caFile := filepath.Join(c.MkDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	c.Assert(ioutil.WriteFile(caFile, ca, 0o644), check.IsNil)
+	listener, mails := newTestSMTPServer(c, &tls.Config{Certificates: server.TLS.Certificates})
+	defer listener.Close()
+	os.Unsetenv("MAILTO")
+
+	config := SMTPConfig{
+		Addr:       listener.Addr().String(),
+		Username:   "cron",
+		Password:   "secret",
+		RequireTLS: true,
+		To:         []string{"ops@example.com"},
+	}
+	notifier, err := newMailNotifier(HTTPConfig{CAFile: caFile}, config, nil)
+	c.Assert(err, check.IsNil)
+	result := newWebhookResult()
+	result.Output = strings.Repeat("x", 100) + "\nprogress=100%\n"
+	_, err = notifier.Notify(context.Background(), result)
+	c.Assert(err, check.IsNil)
+	mail := <-mails
+	c.Assert(mail.TLS, check.Equals, true)
+	c.Assert(mail.Auth, check.Equals, ":cron:secret")
+	// long lines are wrapped and = is encoded
+	c.Assert(mail.Data, check.Matches, "(?s).*\r\nx{75}=\r\nx{25}\r\nprogress=3D100%\r\n$")
+
+	// the certificate is verified
+	notifier, err = newMailNotifier(HTTPConfig{}, config, nil)
+	c.Assert(err, check.IsNil)
+	_, err = notifier.Notify(context.Background(), result)
+	c.Assert(err, check.ErrorMatches, "starttls failed: .*certificate.*")
+}
+
+func (s *Suite) TestMailNotifierRecipients(c *check.C) {
+	config := SMTPConfig{Addr: "localhost:25", To: []string{"ops@example.com"}}
+	defer os.Unsetenv("MAILTO")
+
+	os.Unsetenv("MAILTO")
+	notifier, err := newMailNotifier(HTTPConfig{}, config, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(notifier.to, check.DeepEquals, []string{"ops@example.com"})
+
+	// MAILTO of the crontab replaces the configured recipients
+	os.Setenv("MAILTO", "root, db@example.com")
+	notifier, err = newMailNotifier(HTTPConfig{}, config, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(notifier.to, check.DeepEquals, []string{"root", "db@example.com"})
+
+	// an empty MAILTO disables mails
+	os.Setenv("MAILTO", "")
+	_, err = newMailNotifier(HTTPConfig{}, config, nil)
+	c.Assert(err, check.Equals, errNoRecipients)
+
+	// without a notifier left the failure is not reported as delivered
+	stderr := &bytes.Buffer{}
+	cr := &CmdRequest{Name: "backup", Status: &CmdStatus{Stdout: &bytes.Buffer{}, Stderr: stderr}}
+	cr.Config = &Config{Notifiers: map[string]NotifierConfig{"mail": {SMTP: &config}}}
+	_, err = newReporter(cr)
+	c.Assert(err, check.ErrorMatches, "no notifiers configured")
+	c.Assert(stderr.String(), check.Equals, "")
+
+	// recipients of the job take precedence
+	notifier, err = newMailNotifier(HTTPConfig{}, config, []string{"backup@example.com"})
+	c.Assert(err, check.IsNil)
+	c.Assert(notifier.to, check.DeepEquals, []string{"backup@example.com"})
+}
+
+func (s *Suite) TestMailNotifierTimeout(c *check.C) {
+	// a server that never greets
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+
+	notifier, err := newMailNotifier(HTTPConfig{}, SMTPConfig{Addr: listener.Addr().String(), To: []string{"ops@example.com"}}, nil)
+	c.Assert(err, check.IsNil)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = notifier.Notify(ctx, newWebhookResult())
+	c.Assert(err, check.NotNil)
+	var netErr net.Error
+	c.Assert(errors.As(err, &netErr) && netErr.Timeout(), check.Equals, true)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+type (
+	// SpoolConfig limits the spool of undelivered reports
+	SpoolConfig struct {
+		MaxAge  Duration `yaml:"max_age"`
+		MaxSize int64    `yaml:"max_size"`
+	}
+
+	// spool keeps undelivered envelopes in the state directory until they are delivered
+	spool struct {
+		dir     string
+		maxAge  time.Duration
+		maxSize int64
+	}
+
+	// spooled is an envelope in the spool
+	spooled struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+)
+
+const (
+	// defaultSpoolMaxAge is the time undelivered reports are retried
+	defaultSpoolMaxAge = 7 * 24 * time.Hour
+	// defaultSpoolMaxSize is the maximum size of all undelivered reports
+	defaultSpoolMaxSize = 50 << 20
+)
+
+// newSpool returns the spool of the state directory
+func newSpool(c *Config) *spool {
+	s := &spool{
+		dir:     filepath.Join(c.stateDir(), "spool"),
+		maxAge:  defaultSpoolMaxAge,
+		maxSize: defaultSpoolMaxSize,
+	}
+	if c != nil && c.Spool.MaxAge > 0 {
+		s.maxAge = time.Duration(c.Spool.MaxAge)
+	}
+	if c != nil && c.Spool.MaxSize > 0 {
+		s.maxSize = c.Spool.MaxSize
+	}
+	return s
+}
+
+// write adds an envelope to the spool, the oldest envelopes are dropped if the spool is full
+func (s *spool) write(envelope []byte) error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return fmt.Errorf("unable to create spool directory: %s", err)
+	}
+	name := fmt.Sprintf("%d-%s.envelope", time.Now().UnixNano(), xid.New().String())
+	tmp := filepath.Join(s.dir, "."+name)
+	if err := ioutil.WriteFile(tmp, envelope, 0600); err != nil {
+		return fmt.Errorf("unable to write spool: %s", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, name)); err != nil {
+		return fmt.Errorf("unable to write spool: %s", err)
+	}
+	return s.cleanup(time.Now())
+}
+
+// list returns the spooled envelopes, oldest first
+func (s *spool) list() ([]spooled, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []spooled{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read spool: %s", err)
+	}
+	envelopes := []spooled{}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), ".") || !strings.HasSuffix(file.Name(), ".envelope") {
+			continue
+		}
+		envelopes = append(envelopes, spooled{
+			path:    filepath.Join(s.dir, file.Name()),
+			size:    file.Size(),
+			modTime: file.ModTime(),
+		})
+	}
+	sort.Slice(envelopes, func(i, j int) bool {
+		return filepath.Base(envelopes[i].path) < filepath.Base(envelopes[j].path)
+	})
+	return envelopes, nil
+}
+
+// cleanup drops envelopes older than the maximum age and the oldest envelopes above the maximum size
+func (s *spool) cleanup(now time.Time) error {
+	envelopes, err := s.list()
+	if err != nil {
+		return err
+	}
+	size := int64(0)
+	for _, envelope := range envelopes {
+		size += envelope.size
+	}
+	for _, envelope := range envelopes {
+		if now.Sub(envelope.modTime) <= s.maxAge && size <= s.maxSize {
+			continue
+		}
+		log.Warn().Str("envelope", envelope.path).Msg("dropping undelivered report from spool")
+		_ = os.Remove(envelope.path)
+		size -= envelope.size
+	}
+	return nil
+}
+
+// flush delivers the spooled envelopes, it stops at the first envelope that can not be delivered
+func (s *spool) flush(ctx context.Context, client *http.Client) (delivered int, err error) {
+	if err := s.cleanup(time.Now()); err != nil {
+		return 0, err
+	}
+	envelopes, err := s.list()
+	if err != nil {
+		return 0, err
+	}
+	for _, envelope := range envelopes {
+		data, err := ioutil.ReadFile(envelope.path)
+		if err != nil {
+			return delivered, fmt.Errorf("unable to read spool: %s", err)
+		}
+		dsn, err := envelopeDsn(data)
+		if err != nil {
+			log.Warn().Err(err).Str("envelope", envelope.path).Msg("dropping invalid report from spool")
+			_ = os.Remove(envelope.path)
+			continue
+		}
+		err = postEnvelope(ctx, client, dsn, data)
+		if err != nil && retryable(err) {
+			return delivered, fmt.Errorf("unable to deliver spooled report: %s", err)
+		}
+		if err != nil {
+			log.Warn().Err(err).Str("envelope", envelope.path).Msg("dropping rejected report from spool")
+		} else {
+			delivered++
+		}
+		_ = os.Remove(envelope.path)
+	}
+	return delivered, nil
+}
+
+// envelopeDsn reads the dsn from the envelope header
+func envelopeDsn(envelope []byte) (*sentry.Dsn, error) {
+	line, _ := bufio.NewReader(bytes.NewReader(envelope)).ReadBytes('\n')
+	header := struct {
+		Dsn string `json:"dsn"`
+	}{}
+	if err := json.Unmarshal(line, &header); err != nil {
+		return nil, fmt.Errorf("invalid envelope header: %s", err)
+	}
+	return sentry.NewDsn(header.Dsn)
+}
+
+// spoolCmd manages the spool of undelivered reports, usage: spool flush|list
+func spoolCmd(args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing action, use 'flush' or 'list'")
+	}
+	config := ParseConfig()
+	s := newSpool(config)
+	switch args[0] {
+	case "flush":
+		f := flag.NewFlagSet("spool flush", flag.ExitOnError)
+		if err := f.Parse(args[1:]); err != nil {
+			return err
+		}
+		httpConfig := config.httpConfig()
+		transport, err := httpConfig.transport()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), httpConfig.timeout())
+		defer cancel()
+		delivered, err := s.flush(ctx, &http.Client{Transport: transport})
+		fmt.Printf("delivered %d reports\n", delivered)
+		return err
+	case "list":
+		envelopes, err := s.list()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "REPORT\tSIZE\tAGE\n")
+		for _, envelope := range envelopes {
+			age := time.Since(envelope.modTime).Round(time.Second)
+			fmt.Fprintf(w, "%s\t%d\t%s\n", filepath.Base(envelope.path), envelope.size, age)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown action '%s', use 'flush' or 'list'", args[0])
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestSpool(c *check.C) {
+	mutex := sync.Mutex{}
+	status := http.StatusServiceUnavailable
+	received := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		received++
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	dsn := fmt.Sprintf("http://testuser@%s/7", server.Listener.Addr().String())
+	sp := newSpool(&Config{})
+
+	// undelivered events are spooled
+	transport := &envelopeTransport{spool: sp}
+	transport.Configure(sentry.ClientOptions{Dsn: dsn})
+	transport.SendEvent(sentry.NewEvent())
+	transport.SendEvent(sentry.NewEvent())
+	c.Assert(transport.Flush(5*time.Second), check.Equals, false)
+	envelopes, err := sp.list()
+	c.Assert(err, check.IsNil)
+	c.Assert(envelopes, check.HasLen, 2)
+
+	// sentry is still down
+	delivered, err := sp.flush(context.Background(), http.DefaultClient)
+	c.Assert(err, check.ErrorMatches, "unable to deliver spooled report: 503 Service Unavailable")
+	c.Assert(delivered, check.Equals, 0)
+	envelopes, _ = sp.list()
+	c.Assert(envelopes, check.HasLen, 2)
+
+	// sentry is back
+	mutex.Lock()
+	status = http.StatusOK
+	received = 0
+	mutex.Unlock()
+	delivered, err = sp.flush(context.Background(), http.DefaultClient)
+	c.Assert(err, check.IsNil)
+	c.Assert(delivered, check.Equals, 2)
+	c.Assert(received, check.Equals, 2)
+	envelopes, _ = sp.list()
+	c.Assert(envelopes, check.HasLen, 0)
+
+	// rejected events are not retried
+	transport.SendEvent(sentry.NewEvent())
+	mutex.Lock()
+	status = http.StatusBadRequest
+	mutex.Unlock()
+	transport.SendEvent(sentry.NewEvent())
+	c.Assert(transport.Flush(5*time.Second), check.Equals, false)
+	envelopes, _ = sp.list()
+	c.Assert(envelopes, check.HasLen, 0)
+}
+
+func (s *Suite) TestSpoolCleanup(c *check.C) {
+	sp := newSpool(&Config{Spool: SpoolConfig{MaxAge: Duration(time.Hour), MaxSize: 10}})
+	c.Assert(sp.write([]byte("first\n")), check.IsNil)
+	c.Assert(sp.write([]byte("second\n")), check.IsNil)
+
+	// the oldest envelope is dropped if the spool is full
+	envelopes, err := sp.list()
+	c.Assert(err, check.IsNil)
+	c.Assert(envelopes, check.HasLen, 1)
+	c.Assert(envelopes[0].size, check.Equals, int64(7))
+
+	// expired envelopes are dropped
+	old := time.Now().Add(-2 * time.Hour)
+	c.Assert(os.Chtimes(envelopes[0].path, old, old), check.IsNil)
+	c.Assert(sp.cleanup(time.Now()), check.IsNil)
+	envelopes, _ = sp.list()
+	c.Assert(envelopes, check.HasLen, 0)
+}
+
+func (s *Suite) TestEnvelopeTimeout(c *check.C) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	sp := newSpool(&Config{})
+
+	// a hanging sentry does not block the envelope forever, it is spooled
+	transport := &envelopeTransport{spool: sp, timeout: 200 * time.Millisecond}
+	transport.Configure(sentry.ClientOptions{Dsn: fmt.Sprintf("http://testuser@%s/7", server.Listener.Addr().String())})
+	start := time.Now()
+	transport.SendEvent(sentry.NewEvent())
+	transport.pending.Wait()
+	c.Assert(time.Since(start) < 2*time.Second, check.Equals, true)
+	envelopes, err := sp.list()
+	c.Assert(err, check.IsNil)
+	c.Assert(envelopes, check.HasLen, 1)
+}
+
+func (s *Suite) TestSpoolFlushedBySuccessfulRun(c *check.C) {
+	received := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+	}))
+	defer server.Close()
+	dsn := fmt.Sprintf("http://testuser@%s/7", server.Listener.Addr().String())
+	os.Setenv("CRONGUARD_SENTRY_DSN", dsn)
+	defer os.Unsetenv("CRONGUARD_SENTRY_DSN")
+
+	sp := newSpool(&Config{})
+	envelope, err := buildEnvelope(map[string]interface{}{"dsn": dsn})
+	c.Assert(err, check.IsNil)
+	c.Assert(sp.write(envelope), check.IsNil)
+
+	cr := &CmdRequest{Name: "backup", Command: "backup.sh", Status: &CmdStatus{}}
+	cr.Status.Stdout = &bytes.Buffer{}
+	cr.Status.Stderr = &bytes.Buffer{}
+	reporter, err := newReporter(cr)
+	c.Assert(err, check.IsNil)
+	c.Assert(reporter.Finish(nil), check.IsNil)
+	c.Assert(received, check.HasLen, 1)
+	envelopes, err := sp.list()
+	c.Assert(err, check.IsNil)
+	c.Assert(envelopes, check.HasLen, 0)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type (
+	// jobState is kept between runs of a cron
+	jobState struct {
+		SkippedRuns  int       `json:"skipped_runs"`
+		LastSkip     time.Time `json:"last_skip,omitempty"`
+		StuckAlerted bool      `json:"stuck_alerted,omitempty"` // the stuck lock was reported
+
+		FailedRuns  int               `json:"failed_runs"`
+		FailedSince time.Time         `json:"failed_since,omitempty"`
+		Refs        map[string]string `json:"refs,omitempty"` // notifications of the failed runs by notifier
+	}
+)
+
+// defaultName is the name of crons without -name
+const defaultName = "guard"
+
+// stateName returns the name of the job state. crons without -name share the
+// default name, so they are told apart by their command
+func (cr *CmdRequest) stateName() string {
+	if cr.Name != "" && cr.Name != defaultName {
+		return cr.Name
+	}
+	sum := sha256.Sum256([]byte(cr.Command))
+	return "cmd-" + hex.EncodeToString(sum[:8])
+}
+
+// jobStatePath returns the state file of the cron name
+func jobStatePath(c *Config, name string) string {
+	return filepath.Join(c.stateDir(), "jobs", strings.ReplaceAll(name, "/", "_")+".json")
+}
+
+// loadJobState reads the state of the cron, a missing file is an empty state
+func loadJobState(c *Config, name string) (*jobState, error) {
+	state := &jobState{}
+	data, err := ioutil.ReadFile(jobStatePath(c, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read job state: %s", err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("unable to parse job state: %s", err)
+	}
+	return state, nil
+}
+
+// writeJobState replaces the state of the cron
+func writeJobState(c *Config, name string, state *jobState) error {
+	path := jobStatePath(c, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("unable to create job state directory: %s", err)
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("unable to write job state: %s", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// updateJobState loads, modifies and writes the state of the cron
+func updateJobState(c *Config, name string, update func(state *jobState)) (*jobState, error) {
+	state, err := loadJobState(c, name)
+	if err != nil {
+		return nil, err
+	}
+	update(state)
+	return state, writeJobState(c, name, state)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type (
+	// replay is saved output of a cron that is validated again
+	replay struct {
+		stdout   []byte
+		stderr   []byte
+		exitCode int
+	}
+)
+
+// testRules replays saved output through the output validation and prints the verdict
+func testRules(args []string) error {
+	cr := CmdRequest{}
+	cr.Config = ParseConfig()
+	cr.Status = &CmdStatus{}
+	f := flag.NewFlagSet("test-rules", flag.ExitOnError)
+	stdoutFile := f.String("stdout", "", "file with the saved stdout")
+	stderrFile := f.String("stderr", "", "file with the saved stderr")
+	exitCode := f.Int("exitcode", 0, "exit code of the saved run")
+	errFile := f.String("errfile", "", "error report file to read the run from, requires -uuid")
+	uuid := f.String("uuid", "", "uuid of the run in the error report file")
+	stream := f.String("stream", "", "validate the lines of the error report file as 'stdout' or 'stderr'")
+	parseValidation := validationFlags(f, &cr)
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	if err := parseValidation(); err != nil {
+		return err
+	}
+
+	r := replay{exitCode: *exitCode}
+	var err error
+	switch {
+	case *errFile != "" && *uuid != "":
+		if *stream != "stdout" && *stream != "stderr" {
+			return errors.New("the error report file does not separate stdout and stderr, -errfile requires -stream stdout or stderr")
+		}
+		r, err = readErrFileRun(*errFile, *uuid)
+		if err != nil {
+			return err
+		}
+		if *stream == "stderr" {
+			r.stdout, r.stderr = nil, r.stdout
+		}
+	case *errFile != "":
+		return errors.New("-errfile requires -uuid")
+	default:
+		if *stdoutFile != "" {
+			if r.stdout, err = ioutil.ReadFile(*stdoutFile); err != nil {
+				return fmt.Errorf("unable to read stdout: %s", err)
+			}
+		}
+		if *stderrFile != "" {
+			if r.stderr, err = ioutil.ReadFile(*stderrFile); err != nil {
+				return fmt.Errorf("unable to read stderr: %s", err)
+			}
+		}
+	}
+
+	explainLines(os.Stdout, "stdout", r.stdout, func(line []byte) *OutputError {
+		return checkStdoutLine(&cr, line)
+	}, cr.Rules)
+	explainLines(os.Stdout, "stderr", r.stderr, func(line []byte) *OutputError {
+		return checkStderrLine(&cr, line)
+	}, cr.Rules)
+
+	cr.Status.Stdout = ioutil.Discard
+	cr.Status.Stderr = ioutil.Discard
+	validate := chained(r.runner, validateExitCode, validateStdout, validateStderr)
+	verdict := validate(context.Background(), &cr)
+	fmt.Printf("exitcode: %d", r.exitCode)
+	if exitCode, ok := cr.Rules.exitCode(r.exitCode); ok {
+		fmt.Printf(" (%s: %s)", exitCode.Pack, exitCode.Meaning)
+	}
+	fmt.Printf("\n")
+	if verdict != nil {
+		fmt.Printf("verdict: failed: %s\n", verdict)
+	} else {
+		fmt.Printf("verdict: ok\n")
+	}
+	return nil
+}
+
+// runner writes the saved output like the command would
+func (r replay) runner() GuardFunc {
+	return func(ctx context.Context, cr *CmdRequest) error {
+		if _, err := cr.Status.Stdout.Write(r.stdout); err != nil {
+			return err
+		}
+		if _, err := cr.Status.Stderr.Write(r.stderr); err != nil {
+			return err
+		}
+		cr.Status.ExitCode = r.exitCode
+		if r.exitCode != 0 {
+			return fmt.Errorf("exit status %d", r.exitCode)
+		}
+		return nil
+	}
+}
+
+// explainLines prints the rule that matched for every line of output
+func explainLines(w io.Writer, stream string, output []byte, check func(line []byte) *OutputError, rules *Rules) {
+	i := 0
+	_ = scanLines(bytes.NewReader(output), func(line []byte) {
+		i++
+		if ignored := rules.ignored(line); ignored != nil {
+			fmt.Fprintf(w, "%s:%d: ignored (%s): %s\n", stream, i, ignored, line)
+			return
+		}
+		if bad := check(line); bad != nil {
+			fmt.Fprintf(w, "%s:%d: bad (%s): %s\n", stream, i, bad.Rule, line)
+			return
+		}
+		fmt.Fprintf(w, "%s:%d: ok: %s\n", stream, i, line)
+	})
+}
+
+// readErrFileRun reads the output and exit code of a single run from the error report file
+func readErrFileRun(path string, uuid string) (r replay, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return r, fmt.Errorf("unable to open error report file: %s", err)
+	}
+	defer file.Close()
+
+	prefix := uuid + " "
+	found := false
+	stdout := bytes.NewBuffer(nil)
+	s := bufio.NewScanner(file)
+	s.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for s.Scan() {
+		line := s.Text()
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		found = true
+		line = strings.TrimPrefix(line, prefix)
+		if strings.HasPrefix(line, "// exitcode: ") {
+			r.exitCode, _ = strconv.Atoi(strings.TrimPrefix(line, "// exitcode: "))
+			continue
+		}
+		if strings.HasPrefix(line, "// ") {
+			continue
+		}
+		stdout.WriteString(line + "\n")
+	}
+	if err := s.Err(); err != nil {
+		return r, fmt.Errorf("unable to read error report file: %s", err)
+	}
+	if !found {
+		return r, fmt.Errorf("no run with uuid %s in %s", uuid, path)
+	}
+	r.stdout = stdout.Bytes()
+	return r, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"regexp"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestReadErrFileRun(c *check.C) {
+	f, err := ioutil.TempFile("", "cronstatus")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(f.Name())
+	_, _ = f.WriteString("aaa // start: 2022-02-02T02:02:02Z\naaa hello\naaa // exitcode: 23\nbbb other run\n")
+	f.Close()
+
+	r, err := readErrFileRun(f.Name(), "aaa")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(r.stdout), check.Equals, "hello\n")
+	c.Assert(r.exitCode, check.Equals, 23)
+
+	_, err = readErrFileRun(f.Name(), "ccc")
+	c.Assert(err, check.ErrorMatches, "no run with uuid ccc in .*")
+}
+
+func (s *Suite) TestExplainLines(c *check.C) {
+	rules, err := compileRules([]string{"rsync"}, nil)
+	c.Assert(err, check.IsNil)
+	cr := &CmdRequest{Regex: regexp.MustCompile(`(?i)fail`), Rules: rules}
+
+	out := bytes.NewBuffer(nil)
+	explainLines(out, "stderr", []byte("file has vanished: /tmp/x\nrsync error: timeout\n"), func(line []byte) *OutputError {
+		return checkStderrLine(cr, line)
+	}, rules)
+	explainLines(out, "stdout", []byte("ok\nfailed\n"), func(line []byte) *OutputError {
+		return checkStdoutLine(cr, line)
+	}, rules)
+	c.Assert(out.String(), check.Equals, ""+
+		"stderr:1: ignored (rsync: ^file has vanished: ): file has vanished: /tmp/x\n"+
+		"stderr:2: bad (rsync: ^rsync error: ): rsync error: timeout\n"+
+		"stdout:1: ok: ok\n"+
+		"stdout:2: bad (regex): failed\n",
+	)
+}
+
+func (s *Suite) TestTestRulesStream(c *check.C) {
+	f, err := ioutil.TempFile("", "cronstatus")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(f.Name())
+	_, _ = f.WriteString("aaa hello\naaa // exitcode: 0\n")
+	f.Close()
+
+	// the stream of the lines is unknown
+	err = testRules([]string{"-errfile", f.Name(), "-uuid", "aaa"})
+	c.Assert(err, check.ErrorMatches, ".*-errfile requires -stream stdout or stderr")
+	c.Assert(testRules([]string{"-errfile", f.Name(), "-uuid", "aaa", "-stream", "stderr"}), check.IsNil)
+}
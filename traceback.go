@@ -0,0 +1,177 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+)
+
+var (
+	// python
+	pyStart     = regexp.MustCompile(`^Traceback \(most recent call last\):\s*$`)
+	pyFrame     = regexp.MustCompile(`^\s+File "([^"]+)", line (\d+)(?:, in (.+))?$`)
+	pyException = regexp.MustCompile(`^([A-Za-z_][\w.]*)(?::\s?(.*))?$`)
+
+	// java
+	javaStart = regexp.MustCompile(`^(?:Exception in thread "[^"]*" |Caused by: )?((?:[\w$]+\.)+[\w$]*(?:Exception|Error|Throwable))(?::\s?(.*))?$`)
+	javaFrame = regexp.MustCompile(`^\s+at (?:[\w.$@]+/+)?((?:[\w$<>]+\.)*[\w$<>]+)\.([\w$<>]+)\(([^:)]*)(?::(\d+))?\)$`)
+
+	// go
+	goStart     = regexp.MustCompile(`^(panic|fatal error): (.*)$`)
+	goGoroutine = regexp.MustCompile(`^goroutine \d+ \[.*\]:$`)
+	goFunc      = regexp.MustCompile(`^((?:[\w./-]+/)?[\w-]+(?:\.[\w-]+)?)\.(.+)\(.*\)$`)
+	goLocation  = regexp.MustCompile(`^\s+(.+\.go):(\d+)(?: \+0x[0-9a-f]+)?$`)
+)
+
+// parseTracebacks returns the exceptions of all python, java and go tracebacks in
+// output. the exceptions are ordered like sentry expects them, the cause first.
+func parseTracebacks(output string) []sentry.Exception {
+	lines := strings.Split(strings.ReplaceAll(output, "\r\n", "\n"), "\n")
+	exceptions := []sentry.Exception{}
+	for i := 0; i < len(lines); i++ {
+		var parsed []sentry.Exception
+		var n int
+		switch {
+		case pyStart.MatchString(lines[i]):
+			parsed, n = parsePythonTraceback(lines[i:])
+		case javaStart.MatchString(lines[i]) && i+1 < len(lines) && javaFrame.MatchString(lines[i+1]):
+			parsed, n = parseJavaTraceback(lines[i:])
+		case goStart.MatchString(lines[i]):
+			parsed, n = parseGoTraceback(lines[i:])
+		}
+		if n > 0 {
+			exceptions = append(exceptions, parsed...)
+			i += n - 1
+		}
+	}
+	return exceptions
+}
+
+// parsePythonTraceback parses a python traceback, frames are already ordered oldest first
+func parsePythonTraceback(lines []string) ([]sentry.Exception, int) {
+	frames := []sentry.Frame{}
+	i := 1
+	for ; i < len(lines); i++ {
+		m := pyFrame.FindStringSubmatch(lines[i])
+		if m == nil {
+			// source context line, newer pythons add a line with markers below it
+			if strings.HasPrefix(lines[i], "    ") && len(frames) > 0 {
+				if strings.Trim(lines[i], " ^~") == "" {
+					continue
+				}
+				frames[len(frames)-1].ContextLine = strings.TrimSpace(lines[i])
+				continue
+			}
+			break
+		}
+		lineno, _ := strconv.Atoi(m[2])
+		frames = append(frames, sentry.Frame{
+			Function: m[3],
+			Filename: filepath.Base(m[1]),
+			AbsPath:  m[1],
+			Lineno:   lineno,
+		})
+	}
+	if i >= len(lines) || len(frames) == 0 {
+		return nil, 0
+	}
+	m := pyException.FindStringSubmatch(lines[i])
+	if m == nil {
+		return nil, 0
+	}
+	return []sentry.Exception{{
+		Type:       m[1],
+		Value:      m[2],
+		Stacktrace: &sentry.Stacktrace{Frames: frames},
+	}}, i + 1
+}
+
+// parseJavaTraceback parses a java stack trace including its causes
+func parseJavaTraceback(lines []string) ([]sentry.Exception, int) {
+	exceptions := []sentry.Exception{}
+	i := 0
+	for i < len(lines) {
+		m := javaStart.FindStringSubmatch(lines[i])
+		if m == nil || (i > 0 && !strings.HasPrefix(lines[i], "Caused by: ")) {
+			break
+		}
+		exception := sentry.Exception{Type: m[1], Value: m[2]}
+		frames := []sentry.Frame{}
+		for i++; i < len(lines); i++ {
+			if strings.HasPrefix(strings.TrimSpace(lines[i]), "... ") {
+				continue
+			}
+			f := javaFrame.FindStringSubmatch(lines[i])
+			if f == nil {
+				break
+			}
+			lineno, _ := strconv.Atoi(f[4])
+			frames = append(frames, sentry.Frame{
+				Module:   f[1],
+				Function: f[2],
+				Filename: f[3],
+				Lineno:   lineno,
+			})
+		}
+		// java prints the most recent call first
+		reverseFrames(frames)
+		exception.Stacktrace = &sentry.Stacktrace{Frames: frames}
+		exceptions = append(exceptions, exception)
+	}
+	if len(exceptions) == 0 {
+		return nil, 0
+	}
+	// java prints the cause last, sentry expects it first
+	for l, r := 0, len(exceptions)-1; l < r; l, r = l+1, r-1 {
+		exceptions[l], exceptions[r] = exceptions[r], exceptions[l]
+	}
+	return exceptions, i
+}
+
+// parseGoTraceback parses a go panic, only the first goroutine is used
+func parseGoTraceback(lines []string) ([]sentry.Exception, int) {
+	m := goStart.FindStringSubmatch(lines[0])
+	i := 1
+	for ; i < len(lines) && !goGoroutine.MatchString(lines[i]); i++ {
+		// panics may span multiple lines, for example with [recovered]
+		if i > 3 {
+			return nil, 0
+		}
+	}
+	frames := []sentry.Frame{}
+	for i++; i+1 < len(lines); i += 2 {
+		fn := goFunc.FindStringSubmatch(lines[i])
+		loc := goLocation.FindStringSubmatch(lines[i+1])
+		if fn == nil || loc == nil {
+			break
+		}
+		lineno, _ := strconv.Atoi(loc[2])
+		frames = append(frames, sentry.Frame{
+			Module:   fn[1],
+			Function: fn[2],
+			Filename: filepath.Base(loc[1]),
+			AbsPath:  loc[1],
+			Lineno:   lineno,
+		})
+	}
+	if len(frames) == 0 {
+		return nil, 0
+	}
+	// go prints the most recent call first
+	reverseFrames(frames)
+	return []sentry.Exception{{
+		Type:       m[1],
+		Value:      m[2],
+		Stacktrace: &sentry.Stacktrace{Frames: frames},
+	}}, i
+}
+
+// reverseFrames reverses the order of frames in place
+func reverseFrames(frames []sentry.Frame) {
+	for l, r := 0, len(frames)-1; l < r; l, r = l+1, r-1 {
+		frames[l], frames[r] = frames[r], frames[l]
+	}
+}
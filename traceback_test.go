@@ -0,0 +1,80 @@
+package main
+
+import (
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestParseTracebacksPython(c *check.C) {
+	output := `starting
+Traceback (most recent call last):
+  File "/opt/jobs/export.py", line 12, in <module>
+    main()
+  File "/opt/jobs/export.py", line 8, in main
+    raise ValueError("invalid invoice")
+    ^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^
+ValueError: invalid invoice
+`
+	exceptions := parseTracebacks(output)
+	c.Assert(exceptions, check.HasLen, 1)
+	c.Assert(exceptions[0].Type, check.Equals, "ValueError")
+	c.Assert(exceptions[0].Value, check.Equals, "invalid invoice")
+	frames := exceptions[0].Stacktrace.Frames
+	c.Assert(frames, check.HasLen, 2)
+	c.Assert(frames[0].Function, check.Equals, "<module>")
+	c.Assert(frames[1].Function, check.Equals, "main")
+	c.Assert(frames[1].Filename, check.Equals, "export.py")
+	c.Assert(frames[1].AbsPath, check.Equals, "/opt/jobs/export.py")
+	c.Assert(frames[1].Lineno, check.Equals, 8)
+	c.Assert(frames[1].ContextLine, check.Equals, `raise ValueError("invalid invoice")`)
+}
+
+func (s *Suite) TestParseTracebacksJava(c *check.C) {
+	output := `Exception in thread "main" java.lang.IllegalStateException: import failed
+	at com.example.Import.run(Import.java:42)
+	at com.example.Main.main(Main.java:7)
+Caused by: java.io.IOException: disk full
+	at java.base/java.io.FileOutputStream.writeBytes(Native Method)
+	at com.example.Import.run(Import.java:40)
+	... 1 more
+`
+	exceptions := parseTracebacks(output)
+	c.Assert(exceptions, check.HasLen, 2)
+	c.Assert(exceptions[0].Type, check.Equals, "java.io.IOException")
+	c.Assert(exceptions[0].Value, check.Equals, "disk full")
+	c.Assert(exceptions[1].Type, check.Equals, "java.lang.IllegalStateException")
+	frames := exceptions[1].Stacktrace.Frames
+	c.Assert(frames, check.HasLen, 2)
+	c.Assert(frames[0].Module, check.Equals, "com.example.Main")
+	c.Assert(frames[0].Function, check.Equals, "main")
+	c.Assert(frames[1].Filename, check.Equals, "Import.java")
+	c.Assert(frames[1].Lineno, check.Equals, 42)
+	c.Assert(exceptions[0].Stacktrace.Frames[1].Function, check.Equals, "writeBytes")
+}
+
+func (s *Suite) TestParseTracebacksGo(c *check.C) {
+	output := `panic: runtime error: index out of range [5] with length 3
+
+goroutine 1 [running]:
+github.com/example/job.(*Exporter).Run(0xc000010000)
+	/src/job/exporter.go:21 +0x1d
+main.main()
+	/src/job/main.go:8 +0x25
+exit status 2
+`
+	exceptions := parseTracebacks(output)
+	c.Assert(exceptions, check.HasLen, 1)
+	c.Assert(exceptions[0].Type, check.Equals, "panic")
+	c.Assert(exceptions[0].Value, check.Equals, "runtime error: index out of range [5] with length 3")
+	frames := exceptions[0].Stacktrace.Frames
+	c.Assert(frames, check.HasLen, 2)
+	c.Assert(frames[0].Module, check.Equals, "main")
+	c.Assert(frames[0].Function, check.Equals, "main")
+	c.Assert(frames[1].Module, check.Equals, "github.com/example/job")
+	c.Assert(frames[1].Function, check.Equals, "(*Exporter).Run")
+	c.Assert(frames[1].Lineno, check.Equals, 21)
+}
+
+func (s *Suite) TestParseTracebacksNone(c *check.C) {
+	c.Assert(parseTracebacks("error: something went wrong\nat the end\n"), check.HasLen, 0)
+	c.Assert(parseTracebacks("Traceback (most recent call last):\nnothing\n"), check.HasLen, 0)
+}
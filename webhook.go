@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type (
+	// webhookNotifier sends the run result to a http webhook
+	webhookNotifier struct {
+		url     string
+		method  string
+		headers map[string]string
+		body    *template.Template
+		client  *http.Client
+	}
+
+	// webhookError is returned if the webhook rejected the request
+	webhookError struct {
+		StatusCode int
+		Status     string
+	}
+)
+
+// Error satisfies the error interface
+func (e *webhookError) Error() string {
+	return e.Status
+}
+
+// webhookAttempts is the number of attempts to deliver a webhook on server errors
+const webhookAttempts = 3
+
+// webhookRetryDelay is the delay before the first retry, it doubles with every attempt
+var webhookRetryDelay = time.Second
+
+// newWebhookNotifier creates a webhook notifier, the default body is the run result as json
+func newWebhookNotifier(httpConfig HTTPConfig, config WebhookConfig) (*webhookNotifier, error) {
+	if config.URL == "" {
+		return nil, errors.New("webhook requires an url")
+	}
+	transport, err := httpConfig.transport()
+	if err != nil {
+		return nil, err
+	}
+	method := strings.ToUpper(config.Method)
+	if method == "" {
+		method = http.MethodPost
+	}
+	var body *template.Template
+	if config.Body != "" {
+		body, err = template.New("body").Funcs(templateFuncs).Parse(config.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook body: %s", err)
+		}
+	}
+	return &webhookNotifier{
+		url:     config.URL,
+		method:  method,
+		headers: config.Headers,
+		body:    body,
+		client:  &http.Client{Transport: transport},
+	}, nil
+}
+
+// Notify sends the rendered body to the webhook, server errors are retried
+func (w *webhookNotifier) Notify(ctx context.Context, result *RunResult) (string, error) {
+	body, err := w.render(result)
+	if err != nil {
+		return "", err
+	}
+	return "", w.deliver(ctx, body)
+}
+
+// deliver sends the body to the webhook, server errors are retried
+func (w *webhookNotifier) deliver(ctx context.Context, body []byte) error {
+	delay := webhookRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := w.send(ctx, body)
+		webhookErr := &webhookError{}
+		if errors.As(err, &webhookErr) && webhookErr.StatusCode < 500 {
+			return err
+		}
+		if err == nil || attempt == webhookAttempts {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-ctx.Done():
+			return fmt.Errorf("%s, giving up: %s", err, ctx.Err())
+		}
+	}
+}
+
+// render executes the body template, without a template the result is sent as json
+func (w *webhookNotifier) render(result *RunResult) ([]byte, error) {
+	data := result.data(defaultSummaryLines)
+	if w.body == nil {
+		return json.Marshal(data)
+	}
+	body := &bytes.Buffer{}
+	if err := w.body.Execute(body, data); err != nil {
+		return nil, fmt.Errorf("unable to render webhook body: %s", err)
+	}
+	return body.Bytes(), nil
+}
+
+// send sends the body once
+func (w *webhookNotifier) send(ctx context.Context, body []byte) error {
+	request, err := http.NewRequestWithContext(ctx, w.method, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for key, value := range w.headers {
+		request.Header.Set(key, value)
+	}
+	response, err := w.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode >= 300 {
+		return &webhookError{StatusCode: response.StatusCode, Status: response.Status}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+// newWebhookResult returns a failed run result
+func newWebhookResult() *RunResult {
+	start := time.Now().Add(-90 * time.Second)
+	return &RunResult{
+		Name:     "backup",
+		Command:  "backup.sh",
+		Host:     "db1",
+		UUID:     "c5k2",
+		Start:    start,
+		End:      start.Add(90 * time.Second),
+		ExitCode: 3,
+		Err:      errors.New("exit status 3"),
+		Severity: finishLevel,
+		Output:   "dumping\ndisk full\n",
+	}
+}
+
+func (s *Suite) TestWebhookDefaultBody(c *check.C) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]interface{}{}
+		c.Check(json.NewDecoder(r.Body).Decode(&body), check.IsNil)
+		requests <- r
+		bodies <- body
+	}))
+	defer server.Close()
+
+	notifier, err := newWebhookNotifier(HTTPConfig{}, WebhookConfig{URL: server.URL})
+	c.Assert(err, check.IsNil)
+	_, err = notifier.Notify(context.Background(), newWebhookResult())
+	c.Assert(err, check.IsNil)
+
+	request := <-requests
+	c.Assert(request.Method, check.Equals, http.MethodPost)
+	c.Assert(request.Header.Get("Content-Type"), check.Equals, "application/json")
+	body := <-bodies
+	c.Assert(body["name"], check.Equals, "backup")
+	c.Assert(body["host"], check.Equals, "db1")
+	c.Assert(body["uuid"], check.Equals, "c5k2")
+	c.Assert(body["exit_code"], check.Equals, 3.0)
+	c.Assert(body["severity"], check.Equals, "error")
+	c.Assert(body["duration"], check.Equals, "1m30s")
+	c.Assert(body["error"], check.Equals, "exit status 3")
+	c.Assert(body["output_tail"], check.Equals, "dumping\ndisk full")
+}
+
+func (s *Suite) TestWebhookTemplate(c *check.C) {
+	received := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, check.Equals, http.MethodPut)
+		c.Check(r.Header.Get("Authorization"), check.Equals, "Bearer token")
+		c.Check(r.Header.Get("Content-Type"), check.Equals, "text/plain")
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- string(body)
+	}))
+	defer server.Close()
+
+	notifier, err := newWebhookNotifier(HTTPConfig{}, WebhookConfig{
+		URL:    server.URL,
+		Method: "put",
+		Headers: map[string]string{
+			"Authorization": "Bearer token",
+			"Content-Type":  "text/plain",
+		},
+		Body: `{{.Name}}@{{.Host}} exited {{.ExitCode}} after {{.Duration}}: {{json .Error}} {{tail 1 .Output | json}}`,
+	})
+	c.Assert(err, check.IsNil)
+	_, err = notifier.Notify(context.Background(), newWebhookResult())
+	c.Assert(err, check.IsNil)
+	c.Assert(<-received, check.Equals, `backup@db1 exited 3 after 1m30s: "exit status 3" "disk full"`)
+
+	_, err = newWebhookNotifier(HTTPConfig{}, WebhookConfig{URL: server.URL, Body: "{{.Name"})
+	c.Assert(err, check.ErrorMatches, "invalid webhook body: .*")
+	_, err = newWebhookNotifier(HTTPConfig{}, WebhookConfig{})
+	c.Assert(err, check.ErrorMatches, "webhook requires an url")
+}
+
+func (s *Suite) TestWebhookRetry(c *check.C) {
+	defer func(delay time.Duration) { webhookRetryDelay = delay }(webhookRetryDelay)
+	webhookRetryDelay = 10 * time.Millisecond
+
+	calls := 0
+	status := http.StatusBadGateway
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 2 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	notifier, err := newWebhookNotifier(HTTPConfig{}, WebhookConfig{URL: server.URL})
+	c.Assert(err, check.IsNil)
+
+	// server errors are retried
+	status = http.StatusOK
+	_, err = notifier.Notify(context.Background(), newWebhookResult())
+	c.Assert(err, check.IsNil)
+	c.Assert(calls, check.Equals, 2)
+
+	// until the attempts are exhausted
+	calls, status = 0, http.StatusServiceUnavailable
+	_, err = notifier.Notify(context.Background(), newWebhookResult())
+	c.Assert(err, check.ErrorMatches, "503 Service Unavailable")
+	c.Assert(calls, check.Equals, webhookAttempts)
+
+	// client errors are not retried
+	calls, status = 1, http.StatusBadRequest
+	_, err = notifier.Notify(context.Background(), newWebhookResult())
+	c.Assert(err, check.ErrorMatches, "400 Bad Request")
+	c.Assert(calls, check.Equals, 2)
+}
+
+func (s *Suite) TestWebhookNotifier(c *check.C) {
+	bodies := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(body)
+	}))
+	defer server.Close()
+
+	cr := &CmdRequest{Name: "backup", Command: "backup.sh", Status: &CmdStatus{UUID: "c5k2"}}
+	cr.Status.Stdout = &bytes.Buffer{}
+	cr.Status.Stderr = &bytes.Buffer{}
+	cr.Config = &Config{Notifiers: map[string]NotifierConfig{
+		"router": {Webhook: &WebhookConfig{URL: server.URL, Body: "{{.Severity}} {{.Name}} {{.UUID}}"}},
+		"broken": {},
+	}}
+	reporter, err := newReporter(cr)
+	c.Assert(err, check.IsNil)
+	c.Assert(reporter.notifiers, check.HasLen, 1)
+	c.Assert(reporter.Finish(errors.New("exit status 1")), check.IsNil)
+	c.Assert(<-bodies, check.Equals, "error backup c5k2")
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+type (
+	// Window is a named maintenance window from the config, either cron based or from a calendar or date list
+	Window struct {
+		Cron     string   `yaml:"cron"`
+		Duration Duration `yaml:"duration"`
+		Calendar string   `yaml:"calendar"`
+		Dates    string   `yaml:"dates"`
+		TZ       string   `yaml:"tz"`
+		Mode     string   `yaml:"mode"`
+	}
+
+	// quietWindow is a parsed time range during which errors are ignored
+	quietWindow struct {
+		Name     string
+		Schedule cron.Schedule
+		Duration time.Duration
+		Ranges   []timeRange
+		Location *time.Location
+		Mode     string
+	}
+
+	// QuietError is returned if the cron failed or was skipped during a quiet window or silence
+	QuietError struct {
+		Reason string // the active quiet window or silence
+		Mode   string
+		Err    error // nil if skipped
+	}
+)
+
+const (
+	// quietSilence ignores errors during the window
+	quietSilence = "silence"
+	// quietDowngrade still writes the errfile but reports errors as info
+	quietDowngrade = "downgrade"
+	// quietSkip does not run the command during the window
+	quietSkip = "skip"
+)
+
+// Error satisfies golang error
+func (e *QuietError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("skipped during %s", e.Reason)
+	}
+	return fmt.Sprintf("%s (%s)", e.Err, e.Reason)
+}
+
+// Unwrap returns the original error
+func (e *QuietError) Unwrap() error {
+	return e.Err
+}
+
+// validQuietMode checks if mode is a known quiet mode
+func validQuietMode(mode string) error {
+	switch mode {
+	case quietSilence, quietDowngrade, quietSkip:
+		return nil
+	default:
+		return fmt.Errorf("invalid quiet mode '%s'", mode)
+	}
+}
+
+// compile parses the window, the cron uses the standard five fields
+func (w Window) compile(name string) (*quietWindow, error) {
+	var err error
+	mode := w.Mode
+	if mode == "" {
+		mode = quietSilence
+	}
+	if err := validQuietMode(mode); err != nil {
+		return nil, fmt.Errorf("unable to parse window '%s': %s", name, err)
+	}
+	location := time.Local
+	if w.TZ != "" {
+		location, err = time.LoadLocation(w.TZ)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load time zone of window '%s': %s", name, err)
+		}
+	}
+	window := &quietWindow{
+		Name:     name,
+		Duration: time.Duration(w.Duration),
+		Location: location,
+		Mode:     mode,
+	}
+	switch {
+	case w.Calendar != "":
+		window.Ranges, err = loadCalendar(w.Calendar, location)
+	case w.Dates != "":
+		window.Ranges, err = loadDateList(w.Dates, location)
+	default:
+		window.Schedule, err = cron.ParseStandard(w.Cron)
+		if err != nil {
+			err = fmt.Errorf("unable to parse cron time: %s", err)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse window '%s': %s", name, err)
+	}
+	return window, nil
+}
+
+// active checks if now is within the window
+func (w *quietWindow) active(now time.Time) bool {
+	now = now.In(w.Location)
+	for _, r := range w.Ranges {
+		if r.contains(now) {
+			return true
+		}
+	}
+	if w.Schedule == nil {
+		return false
+	}
+	start := w.Schedule.Next(now.Add(-w.Duration))
+	end := start.Add(w.Duration)
+	return now.After(start) && end.After(now)
+}
+
+// parseQuietTimes parses the quiet-times flag, format 'start(cron format):duration(golang duration):...'
+func parseQuietTimes(quietTimes string, mode string) ([]*quietWindow, error) {
+	windows := []*quietWindow{}
+	if quietTimes == "" {
+		return windows, nil
+	}
+	ts := strings.Split(quietTimes, ":")
+	if len(ts)%2 != 0 {
+		return nil, fmt.Errorf("invalid quiet-times format")
+	}
+	for i := 0; i < len(ts); i += 2 {
+		shed, err := cron.Parse(ts[i])
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse cron time: %s", err)
+		}
+		dur, err := time.ParseDuration(ts[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse duration: %s", err)
+		}
+		windows = append(windows, &quietWindow{
+			Name:     fmt.Sprintf("%s:%s", ts[i], ts[i+1]),
+			Schedule: shed,
+			Duration: dur,
+			Location: time.Local,
+			Mode:     mode,
+		})
+	}
+	return windows, nil
+}
+
+// quietWindows returns the quiet-times and the named windows selected by quiet-windows
+func quietWindows(cr *CmdRequest) ([]*quietWindow, error) {
+	mode := cr.QuietMode
+	if mode == "" {
+		mode = quietSilence
+	}
+	windows, err := parseQuietTimes(cr.QuietTimes, mode)
+	if err != nil {
+		return nil, err
+	}
+	if cr.QuietWindows == "" {
+		return windows, nil
+	}
+	configured := map[string]Window{}
+	if cr.Config != nil {
+		configured = cr.Config.Windows
+	}
+	for _, name := range strings.Split(cr.QuietWindows, ",") {
+		name = strings.TrimSpace(name)
+		window, ok := configured[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown window '%s'", name)
+		}
+		compiled, err := window.compile(name)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, compiled)
+	}
+	return windows, nil
+}
+
+// activeQuietWindow returns the first active quiet window or nil
+func activeQuietWindow(cr *CmdRequest, now time.Time) (*quietWindow, error) {
+	windows, err := quietWindows(cr)
+	if err != nil {
+		return nil, err
+	}
+	for _, window := range windows {
+		if window.active(now) {
+			return window, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"time"
+
+	"gopkg.in/check.v1"
+	"gopkg.in/yaml.v2"
+)
+
+func (s *Suite) TestQuietWindows(c *check.C) {
+	config := Config{}
+	err := yaml.Unmarshal([]byte(`
+windows:
+  db-backup:
+    cron: "0 2 * * *"
+    duration: 42m
+    tz: Europe/Berlin
+    mode: skip
+  bad-mode:
+    cron: "0 2 * * *"
+    duration: 42m
+    mode: sometimes
+  broken:
+    cron: "0 2 * * *"
+    duration: 42m
+    tz: Nowhere/Nothing
+`), &config)
+	c.Assert(err, check.IsNil)
+	c.Assert(config.Windows["db-backup"].Duration, check.Equals, Duration(42*time.Minute))
+
+	cr := &CmdRequest{Config: &config, QuietWindows: "db-backup"}
+	berlin := time.FixedZone("CEST", 2*60*60)
+	window, err := activeQuietWindow(cr, time.Date(2022, 6, 1, 2, 10, 0, 0, berlin))
+	c.Assert(err, check.IsNil)
+	c.Assert(window, check.NotNil)
+	c.Assert(window.Name, check.Equals, "db-backup")
+	c.Assert(window.Mode, check.Equals, quietSkip)
+	window, err = activeQuietWindow(cr, time.Date(2022, 6, 1, 0, 10, 0, 0, time.UTC))
+	c.Assert(err, check.IsNil)
+	c.Assert(window, check.NotNil)
+	window, err = activeQuietWindow(cr, time.Date(2022, 6, 1, 2, 50, 0, 0, berlin))
+	c.Assert(err, check.IsNil)
+	c.Assert(window, check.IsNil)
+
+	// old flag syntax and named windows together
+	cr.QuietTimes = "0 0 12 * * *:1h"
+	window, err = activeQuietWindow(cr, time.Date(2022, 6, 1, 12, 30, 0, 0, time.Local))
+	c.Assert(err, check.IsNil)
+	c.Assert(window.Name, check.Equals, "0 0 12 * * *:1h")
+	c.Assert(window.Mode, check.Equals, quietSilence)
+
+	cr.QuietWindows = "db-backup, unknown"
+	_, err = activeQuietWindow(cr, time.Now())
+	c.Assert(err, check.ErrorMatches, "unknown window 'unknown'")
+	cr.QuietWindows = "bad-mode"
+	_, err = activeQuietWindow(cr, time.Now())
+	c.Assert(err, check.ErrorMatches, "unable to parse window 'bad-mode': invalid quiet mode 'sometimes'")
+	cr.QuietWindows = "broken"
+	_, err = activeQuietWindow(cr, time.Now())
+	c.Assert(err, check.ErrorMatches, "unable to load time zone of window 'broken': .*")
+	cr.QuietTimes = "0 0 12 * * *"
+	_, err = activeQuietWindow(cr, time.Now())
+	c.Assert(err, check.ErrorMatches, "invalid quiet-times format")
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"io"
 	"sync"
+	"time"
 )
 
 // WriteCounter contains an embedded io.Writer and counts all writes.
@@ -35,12 +36,18 @@ func (wc *WriteCounter) GetCounter() int64 {
 // LockedWriter prevents concurrent writes
 type LockedWriter struct {
 	io.Writer
-	lock sync.Mutex
+	lock *sync.Mutex
 }
 
 // NewLockedWriter creates a new *LockedWriter
 func NewLockedWriter(w io.Writer) *LockedWriter {
-	return &LockedWriter{Writer: w}
+	return &LockedWriter{Writer: w, lock: &sync.Mutex{}}
+}
+
+// NewSharedLockedWriter creates a new *LockedWriter that uses lock, the owner
+// of the lock can read what was written while the writes continue
+func NewSharedLockedWriter(w io.Writer, lock *sync.Mutex) *LockedWriter {
+	return &LockedWriter{Writer: w, lock: lock}
 }
 
 // Write writes len(p) bytes from p to the underlying data stream.
@@ -53,3 +60,47 @@ func (lw *LockedWriter) Write(p []byte) (n int, err error) {
 	defer lw.lock.Unlock()
 	return lw.Writer.Write(p)
 }
+
+// ActivityTracker remembers the time of the last write to any of its wrapped writers
+type ActivityTracker struct {
+	last time.Time
+	lock sync.Mutex
+}
+
+// NewActivityTracker creates a new *ActivityTracker starting now
+func NewActivityTracker() *ActivityTracker {
+	return &ActivityTracker{last: time.Now()}
+}
+
+// Wrap returns an io.Writer that marks activity on every write to w
+func (at *ActivityTracker) Wrap(w io.Writer) io.Writer {
+	return &activityWriter{Writer: w, tracker: at}
+}
+
+// Touch marks activity
+func (at *ActivityTracker) Touch() {
+	at.lock.Lock()
+	defer at.lock.Unlock()
+	at.last = time.Now()
+}
+
+// Last returns the time of the last activity
+func (at *ActivityTracker) Last() time.Time {
+	at.lock.Lock()
+	defer at.lock.Unlock()
+	return at.last
+}
+
+// activityWriter contains an embedded io.Writer and marks activity on its tracker
+type activityWriter struct {
+	io.Writer
+	tracker *ActivityTracker
+}
+
+// Write writes len(p) bytes from p to the underlying data stream.
+func (aw *activityWriter) Write(p []byte) (n int, err error) {
+	if len(p) > 0 {
+		aw.tracker.Touch()
+	}
+	return aw.Writer.Write(p)
+}